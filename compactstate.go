@@ -0,0 +1,352 @@
+package wilddawg
+
+import (
+	"bytes"
+	"hash"
+	"sort"
+
+	"github.com/ugorji/go/codec"
+)
+
+type SortedSliceEdge struct {
+	Key         []byte
+	Transition  interface{}
+	Destination State
+}
+
+// This implementation stores its edges in a slice sorted by the canonical
+// encoding of each transition, and finds edges by binary search. It avoids the
+// fixed overhead of a map for states with few outgoing edges, which make up
+// most of a DAWG, at the cost of encoding each queried transition. It hashes
+// identically to LazyDfaAnnotatedState, so the two can share a register.
+type SortedSliceDfaAnnotatedState struct {
+	Id          StateId
+	Edges       []SortedSliceEdge
+	Encoding    codec.Handle
+	HashFunc    hash.Hash32
+	Annotations map[interface{}]bool
+	UserData    map[interface{}]interface{}
+	Type        StateType
+}
+
+func NewSortedSliceDfaAnnotatedState(id StateId, encoding codec.Handle,
+	hashFunc hash.Hash32) *SortedSliceDfaAnnotatedState {
+	return &SortedSliceDfaAnnotatedState{
+		Id:          id,
+		Edges:       make([]SortedSliceEdge, 0),
+		Encoding:    encoding,
+		HashFunc:    hashFunc,
+		Type:        SORTEDSLICEDFAANNOTATED,
+		Annotations: make(map[interface{}]bool),
+		UserData:    nil,
+	}
+}
+
+func (s *SortedSliceDfaAnnotatedState) GetId() StateId {
+	return s.Id
+}
+
+func (s *SortedSliceDfaAnnotatedState) SetId(id StateId) error {
+	s.Id = id
+	return nil
+}
+
+func (s *SortedSliceDfaAnnotatedState) AddAnnotation(
+	annotation interface{}) error {
+	s.Annotations[annotation] = true
+	return nil
+}
+
+func (s *SortedSliceDfaAnnotatedState) RemoveAnnotation(
+	annotation interface{}) error {
+	if _, present := s.Annotations[annotation]; !present {
+		return ErrAnnotationInvalid
+	}
+	delete(s.Annotations, annotation)
+	return nil
+}
+
+func (s *SortedSliceDfaAnnotatedState) GetAnnotations() ([]interface{},
+	error) {
+	annotationList := make([]interface{}, 0, len(s.Annotations))
+	for annotation := range s.Annotations {
+		annotationList = append(annotationList, annotation)
+	}
+	return annotationList, nil
+}
+
+func (s *SortedSliceDfaAnnotatedState) SetUserData(key interface{},
+	value interface{}) {
+	if s.UserData == nil {
+		s.UserData = make(map[interface{}]interface{})
+	}
+	s.UserData[key] = value
+}
+
+func (s *SortedSliceDfaAnnotatedState) GetUserData(key interface{}) (
+	interface{}, bool) {
+	value, present := s.UserData[key]
+	return value, present
+}
+
+func (s *SortedSliceDfaAnnotatedState) AddEdge(edgeTransition interface{},
+	destination State) error {
+	key, err := s.encodeTransition(edgeTransition)
+	if err != nil {
+		return err
+	}
+	i, present := s.searchEdges(key, edgeTransition)
+	if present {
+		return ErrEdgeAlreadyUsed
+	}
+	s.Edges = append(s.Edges, SortedSliceEdge{})
+	copy(s.Edges[i+1:], s.Edges[i:])
+	s.Edges[i] = SortedSliceEdge{
+		Key:         key,
+		Transition:  edgeTransition,
+		Destination: destination,
+	}
+	return nil
+}
+
+func (s *SortedSliceDfaAnnotatedState) RemoveEdge(edgeTransition interface{},
+	destination State) error {
+	key, err := s.encodeTransition(edgeTransition)
+	if err != nil {
+		return err
+	}
+	if i, present := s.searchEdges(key, edgeTransition); !present {
+		return ErrEdgeNotPresent
+	} else if s.Edges[i].Destination != destination {
+		return ErrEdgeNotPresent
+	} else {
+		s.Edges = append(s.Edges[:i], s.Edges[i+1:]...)
+	}
+	return nil
+}
+
+func (s *SortedSliceDfaAnnotatedState) FollowEdge(
+	edgeTransition interface{}) []State {
+	destinationStates := make([]State, 0)
+	if key, err := s.encodeTransition(edgeTransition); err != nil {
+		return destinationStates
+	} else if i, present := s.searchEdges(key, edgeTransition); present {
+		destinationStates = append(destinationStates, s.Edges[i].Destination)
+	}
+	return destinationStates
+}
+
+func (s *SortedSliceDfaAnnotatedState) FollowAllEdges() []State {
+	uniqueDestinations := make(map[State]bool)
+	destinationStates := make([]State, 0, len(s.Edges))
+	for _, edge := range s.Edges {
+		if _, seen := uniqueDestinations[edge.Destination]; !seen {
+			uniqueDestinations[edge.Destination] = true
+			destinationStates = append(destinationStates, edge.Destination)
+		}
+	}
+	return destinationStates
+}
+
+func (s *SortedSliceDfaAnnotatedState) EdgesTo(
+	destination State) []interface{} {
+	edgeTransitions := make([]interface{}, 0)
+	for _, edge := range s.Edges {
+		if edge.Destination == destination {
+			edgeTransitions = append(edgeTransitions, edge.Transition)
+		}
+	}
+	return edgeTransitions
+}
+
+func (s *SortedSliceDfaAnnotatedState) MachineEdges() map[interface{}]StateId {
+	machineEdges := make(map[interface{}]StateId, len(s.Edges))
+	for _, edge := range s.Edges {
+		machineEdges[edge.Transition] = edge.Destination.GetId()
+	}
+	return machineEdges
+}
+
+// Returns the edges in their stored order, which is already the one
+// sortEdgePairs gives them.
+func (s *SortedSliceDfaAnnotatedState) StableEdges() []EdgePair {
+	edgePairs := make([]EdgePair, 0, len(s.Edges))
+	for _, edge := range s.Edges {
+		edgePairs = append(edgePairs, EdgePair{
+			Transition:  edge.Transition,
+			Destination: edge.Destination,
+		})
+	}
+	return edgePairs
+}
+
+func (s *SortedSliceDfaAnnotatedState) IsomorphismHash() (interface{},
+	error) {
+	return encodeHash(s.MachineEdges(), s.Encoding, s.HashFunc)
+}
+
+// Two states are equal when their machine edges are. Annotations and user data
+// are not compared, matching IsomorphismHash, but a state with key/value
+// annotations or hashed edge data never equals this one, so that equality is
+// symmetric.
+func (s *SortedSliceDfaAnnotatedState) Equals(other State) (bool, error) {
+	return s.EqualsWith(other, nil)
+}
+
+func (s *SortedSliceDfaAnnotatedState) EqualsWith(other State,
+	symbolEqual SymbolEqualFunc) (bool, error) {
+	if other == nil {
+		return false, nil
+	}
+	return sameMachineEdgesWith(s.MachineEdges(), other.MachineEdges(),
+		symbolEqual) && sameKVAnnotations(s, other) &&
+		sameHashedEdgeData(s, other, nil), nil
+}
+
+func (s *SortedSliceDfaAnnotatedState) Clone() State {
+	clone := NewSortedSliceDfaAnnotatedState(s.Id, s.Encoding, s.HashFunc)
+	clone.Edges = make([]SortedSliceEdge, len(s.Edges))
+	copy(clone.Edges, s.Edges)
+	for annotation, placeholder := range s.Annotations {
+		clone.Annotations[annotation] = placeholder
+	}
+	for key, value := range s.UserData {
+		clone.SetUserData(key, value)
+	}
+	return clone
+}
+
+func (s *SortedSliceDfaAnnotatedState) CloneDeep() State {
+	return cloneDeep(s)
+}
+
+func (s *SortedSliceDfaAnnotatedState) GetStateType() StateType {
+	return s.Type
+}
+
+func (s *SortedSliceDfaAnnotatedState) String() string {
+	return formatState(s)
+}
+
+func (s *SortedSliceDfaAnnotatedState) encodeTransition(
+	edgeTransition interface{}) ([]byte, error) {
+	if s.Encoding == nil {
+		return nil, ErrNilEncoder
+	}
+	key := make([]byte, 0, 16)
+	encoder := codec.NewEncoderBytes(&key, s.Encoding)
+	if err := encoder.Encode(edgeTransition); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Returns the position of the edge for the transition, whose encoding is key,
+// or the position at which it would be inserted if it is not present.
+// Distinct transitions can encode alike, e.g. int(1) and int64(1), so within
+// a run of equal keys the transitions are compared with ==, as a map would,
+// and kept in the order sortEdgePairs gives them.
+func (s *SortedSliceDfaAnnotatedState) searchEdges(key []byte,
+	edgeTransition interface{}) (int, bool) {
+	i := sort.Search(len(s.Edges), func(i int) bool {
+		return bytes.Compare(s.Edges[i].Key, key) >= 0
+	})
+	insertAt := -1
+	for ; i < len(s.Edges) && bytes.Equal(s.Edges[i].Key, key); i++ {
+		if s.Edges[i].Transition == edgeTransition {
+			return i, true
+		} else if insertAt < 0 && transitionTieKey(s.Edges[i].Transition) >
+			transitionTieKey(edgeTransition) {
+			insertAt = i
+		}
+	}
+	if insertAt >= 0 {
+		return insertAt, false
+	}
+	return i, false
+}
+
+// Replaces every canonically hashed LazyDfaAnnotatedState without HashFunc2 or
+// TransitionKeyFunc reachable from the start state that has fewer than
+// threshold outgoing edges with an equivalent SortedSliceDfaAnnotatedState,
+// keeping Ids, annotations, user data and encodings. Remaining states are
+// rewired in place to point at the replacements. The returned state is the
+// start state of the compacted machine. If a replacement cannot be built, e.g.
+// because a transition cannot be encoded, the machine is left as it was. Any
+// register holding states of the old machine must be initialized again
+// afterwards.
+func CompactEdges(startState State, threshold int) (State, error) {
+	if startState == nil {
+		return nil, ErrRegisterNilState
+	}
+
+	reachableStates := make([]State, 0)
+	replacements := make(map[StateId]State)
+	seenStates := map[StateId]bool{startState.GetId(): true}
+	stack := []State{startState}
+	for len(stack) != 0 {
+		curr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		reachableStates = append(reachableStates, curr)
+
+		replacement := curr
+		if lazyState, ok := curr.(*LazyDfaAnnotatedState); ok &&
+			!lazyState.IncrementalHash && lazyState.HashFunc2 == nil &&
+			lazyState.TransitionKeyFunc == nil &&
+			len(lazyState.Edges) < threshold {
+			compactState := NewSortedSliceDfaAnnotatedState(lazyState.Id,
+				lazyState.Encoding, lazyState.HashFunc)
+			annotations, err := lazyState.GetAnnotations()
+			if err != nil {
+				return nil, err
+			}
+			for _, annotation := range annotations {
+				compactState.Annotations[annotation] = true
+			}
+			for key, value := range lazyState.UserData {
+				compactState.SetUserData(key, value)
+			}
+			replacement = compactState
+		}
+		replacements[curr.GetId()] = replacement
+
+		for _, next := range curr.FollowAllEdges() {
+			nextId := next.GetId()
+			if _, seen := seenStates[nextId]; !seen {
+				stack = append(stack, next)
+				seenStates[nextId] = true
+			}
+		}
+	}
+
+	// Fill in every replacement before rewiring any remaining state.
+	for _, curr := range reachableStates {
+		replacement := replacements[curr.GetId()]
+		if replacement == curr {
+			continue
+		}
+		for edge, destId := range curr.MachineEdges() {
+			if err := replacement.AddEdge(edge,
+				replacements[destId]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, curr := range reachableStates {
+		if replacements[curr.GetId()] != curr {
+			continue
+		}
+		for edge, destId := range curr.MachineEdges() {
+			destination := curr.FollowEdge(edge)[0]
+			if newDestination := replacements[destId]; newDestination !=
+				destination {
+				if err := redirectEdge(curr, edge, destination,
+					newDestination); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return replacements[startState.GetId()], nil
+}
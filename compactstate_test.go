@@ -0,0 +1,303 @@
+package wilddawg
+
+import (
+	"fmt"
+	"hash/fnv"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestSortedSliceDfaAnnotatedStateEdge(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	var testStateA State = NewSortedSliceDfaAnnotatedState(1, codecHandle,
+		fnv.New32())
+	var testStateB State = NewSortedSliceDfaAnnotatedState(2, codecHandle,
+		fnv.New32())
+	var testStateC State = NewSortedSliceDfaAnnotatedState(3, codecHandle,
+		fnv.New32())
+
+	for _, edge := range []interface{}{"c", "a", 7, "b"} {
+		if err := testStateA.AddEdge(edge, testStateB); err != nil {
+			t.Errorf("Error while adding edge: %q", err)
+		}
+	}
+	if err := testStateA.AddEdge("a", testStateC); err != ErrEdgeAlreadyUsed {
+		t.Errorf("Expected %q, got %q", ErrEdgeAlreadyUsed, err)
+	}
+	for _, edge := range []interface{}{"a", "b", "c", 7} {
+		if dest := testStateA.FollowEdge(edge); len(dest) != 1 {
+			t.Errorf("Destination state count %d, want 1", len(dest))
+		} else if dest[0] != testStateB {
+			t.Errorf("Result state %v, wanted %v", dest[0], testStateB)
+		}
+	}
+	if dest := testStateA.FollowEdge("x"); len(dest) != 0 {
+		t.Errorf("Destination state count %d, want 0", len(dest))
+	}
+	if dest := testStateA.FollowAllEdges(); len(dest) != 1 {
+		t.Errorf("Destination state count %d (%v), want 1", len(dest), dest)
+	}
+
+	if err := testStateA.RemoveEdge("a", testStateC); err != ErrEdgeNotPresent {
+		t.Errorf("Expected %q, got %q", ErrEdgeNotPresent, err)
+	}
+	if err := testStateA.RemoveEdge("b", testStateB); err != nil {
+		t.Errorf("Error while removing edge: %q", err)
+	}
+	if dest := testStateA.FollowEdge("b"); len(dest) != 0 {
+		t.Errorf("Destination state count %d, want 0", len(dest))
+	}
+
+	var testStateD State = NewSortedSliceDfaAnnotatedState(4, nil, nil)
+	if err := testStateD.AddEdge("a", testStateB); err != ErrNilEncoder {
+		t.Errorf("Expected %q, got %q", ErrNilEncoder, err)
+	}
+}
+
+func TestSortedSliceDfaAnnotatedStateString(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	testStateA := NewSortedSliceDfaAnnotatedState(1, codecHandle, nil)
+	testStateB := NewSortedSliceDfaAnnotatedState(2, codecHandle, nil)
+
+	for _, edge := range []interface{}{"c", "a", "b"} {
+		if err := testStateA.AddEdge(edge, testStateB); err != nil {
+			t.Errorf("Error while adding edge: %q", err)
+		}
+	}
+	if err := testStateA.AddAnnotation("x"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	expected := "1 {x}: a->2 b->2 c->2"
+	if str := fmt.Sprint(testStateA); str != expected {
+		t.Errorf("Expected %q, got %q", expected, str)
+	}
+}
+
+func TestCompactEdges(t *testing.T) {
+	states := newCatBatMachine(t)
+	if err := states[3].AddAnnotation("end"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+
+	expectedEdges := make(map[StateId]map[interface{}]StateId)
+	expectedHashes := make(map[StateId]interface{})
+	for _, state := range states {
+		expectedEdges[state.GetId()] = state.MachineEdges()
+		if hash, err := state.IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else {
+			expectedHashes[state.GetId()] = hash
+		}
+	}
+
+	startState, err := CompactEdges(states[0], 2)
+	if err != nil {
+		t.Fatalf("Error while compacting edges: %q", err)
+	}
+	if startState != states[0] {
+		t.Errorf("Expected start state with 2 edges to be kept")
+	}
+
+	compactStates := []State{startState}
+	for _, edge := range []interface{}{"c", "a", "t"} {
+		curr := compactStates[len(compactStates)-1]
+		if dest := curr.FollowEdge(edge); len(dest) != 1 {
+			t.Fatalf("Destination state count %d, want 1", len(dest))
+		} else {
+			compactStates = append(compactStates, dest[0])
+		}
+	}
+
+	for i, state := range compactStates {
+		id := state.GetId()
+		if id != states[i].GetId() {
+			t.Errorf("State Id %d, want %d", id, states[i].GetId())
+		}
+		if i > 0 && state.GetStateType() != SORTEDSLICEDFAANNOTATED {
+			t.Errorf("State %d type %d, want %d", id, state.GetStateType(),
+				SORTEDSLICEDFAANNOTATED)
+		}
+		if edges := state.MachineEdges(); !sameMachineEdges(edges,
+			expectedEdges[id]) {
+			t.Errorf("Expected %v, got %v", expectedEdges[id], edges)
+		}
+		if hash, err := state.IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if hash != expectedHashes[id] {
+			t.Errorf("Expected hash %d, got %d", expectedHashes[id], hash)
+		}
+	}
+	if dest := startState.FollowEdge("b"); len(dest) != 1 ||
+		dest[0] != compactStates[1] {
+		t.Errorf("Expected edge \"b\" to be rewired to %v, got %v",
+			compactStates[1], dest)
+	}
+	if annotations, err := compactStates[3].GetAnnotations(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if !slicesSameValues(annotations, []interface{}{"end"}) {
+		t.Errorf("Expected annotations [end], got %v", annotations)
+	}
+
+	register := NewCollisionSafeHashMapRegister()
+	if err := register.Initialize(startState); err != nil {
+		t.Errorf("Error while initializing register: %q", err)
+	}
+
+	// int(1) and int64(1) encode alike but are distinct map keys, so they
+	// must stay distinct edges after compaction.
+	states = newTestStates(t, newTestStateFactory(t), 4)
+	addTestEdge(t, states[0], "x", states[1])
+	addTestEdge(t, states[1], int(1), states[2])
+	addTestEdge(t, states[1], int64(1), states[3])
+	expectedMachineEdges := states[1].MachineEdges()
+	if startState, err = CompactEdges(states[0], 3); err != nil {
+		t.Fatalf("Error while compacting edges: %q", err)
+	}
+	compactState := startState.FollowEdge("x")[0]
+	if compactState.GetStateType() != SORTEDSLICEDFAANNOTATED {
+		t.Errorf("State type %d, want %d", compactState.GetStateType(),
+			SORTEDSLICEDFAANNOTATED)
+	}
+	if edges := compactState.MachineEdges(); !sameMachineEdges(edges,
+		expectedMachineEdges) {
+		t.Errorf("Expected %v, got %v", expectedMachineEdges, edges)
+	}
+	for edge, destId := range map[interface{}]StateId{
+		int(1): states[2].GetId(), int64(1): states[3].GetId()} {
+		if dest := compactState.FollowEdge(edge); len(dest) != 1 ||
+			dest[0].GetId() != destId {
+			t.Errorf("Edge %T(%v) leads to %v, want state %d", edge, edge,
+				dest, destId)
+		}
+	}
+	destination := compactState.FollowEdge(int64(1))[0]
+	if err := compactState.RemoveEdge(int64(1), destination); err != nil {
+		t.Errorf("Error while removing edge: %q", err)
+	}
+	if dest := compactState.FollowEdge(int(1)); len(dest) != 1 {
+		t.Errorf("Expected edge int(1) to remain, got %v", dest)
+	}
+}
+
+func TestCompactEdgesTransitionKeyFunc(t *testing.T) {
+	factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+	factory.TransitionKeyFunc = func(edge interface{}) interface{} {
+		return edge.(*testPointerSymbol).Name
+	}
+	states := newTestStates(t, factory, 4)
+	symbols := []*testPointerSymbol{{Name: "a"}, {Name: "b"}}
+	addTestEdge(t, states[0], "x", states[1])
+	addTestEdge(t, states[1], symbols[0], states[2])
+	addTestEdge(t, states[1], symbols[1], states[3])
+	expectedHash, err := states[1].IsomorphismHash()
+	if err != nil {
+		t.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+	}
+
+	startState, err := CompactEdges(states[0], 5)
+	if err != nil {
+		t.Fatalf("Error while compacting edges: %q", err)
+	}
+	keyedState := startState.FollowEdge("x")[0]
+	if hash, err := keyedState.IsomorphismHash(); err != nil {
+		t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+	} else if hash != expectedHash {
+		t.Errorf("Expected hash %d, got %d", expectedHash, hash)
+	}
+	for i, symbol := range symbols {
+		if dest := keyedState.FollowEdge(symbol); len(dest) != 1 ||
+			dest[0].GetId() != states[i+2].GetId() {
+			t.Errorf("Edge %v leads to %v, want state %d", symbol.Name, dest,
+				states[i+2].GetId())
+		}
+	}
+}
+
+func TestCompactEdgesError(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	startState := NewLazyDfaAnnotatedState(1, codecHandle, fnv.New32())
+	unencodableState := NewLazyDfaAnnotatedState(2, nil, fnv.New32())
+	leaf := NewLazyDfaAnnotatedState(3, codecHandle, fnv.New32())
+	for _, edge := range []interface{}{"a", "b", "c"} {
+		addTestEdge(t, startState, edge, unencodableState)
+	}
+	addTestEdge(t, unencodableState, "x", leaf)
+	expected := MachineString(startState)
+
+	if _, err := CompactEdges(startState, 2); err != ErrNilEncoder {
+		t.Errorf("Expected %q, got %q", ErrNilEncoder, err)
+	}
+	for _, edge := range []interface{}{"a", "b", "c"} {
+		if dest := startState.FollowEdge(edge); len(dest) != 1 ||
+			dest[0] != unencodableState {
+			t.Errorf("Edge %v leads to %v, want state %d", edge, dest,
+				unencodableState.GetId())
+		}
+	}
+	if machineString := MachineString(startState); machineString !=
+		expected {
+		t.Errorf("Expected %q, got %q", expected, machineString)
+	}
+}
+
+func benchmarkFollowEdge(b *testing.B, state State, destination State) {
+	edges := []interface{}{"a", "e", "i", "o"}
+	for _, edge := range edges {
+		if err := state.AddEdge(edge, destination); err != nil {
+			b.Fatalf("Error while adding edge: %q", err)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		state.FollowEdge(edges[i%len(edges)])
+	}
+}
+
+func BenchmarkLazyDfaAnnotatedStateFollowEdge(b *testing.B) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	benchmarkFollowEdge(b, NewLazyDfaAnnotatedState(1, codecHandle, nil),
+		NewLazyDfaAnnotatedState(2, codecHandle, nil))
+}
+
+func BenchmarkSortedSliceDfaAnnotatedStateFollowEdge(b *testing.B) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	benchmarkFollowEdge(b, NewSortedSliceDfaAnnotatedState(1, codecHandle,
+		nil), NewSortedSliceDfaAnnotatedState(2, codecHandle, nil))
+}
+
+func benchmarkBuildState(b *testing.B, newState func() State) {
+	destination := newState()
+	edges := []interface{}{"a", "e", "i", "o"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		state := newState()
+		for _, edge := range edges {
+			if err := state.AddEdge(edge, destination); err != nil {
+				b.Fatalf("Error while adding edge: %q", err)
+			}
+		}
+	}
+}
+
+func BenchmarkLazyDfaAnnotatedStateBuild(b *testing.B) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	benchmarkBuildState(b, func() State {
+		return NewLazyDfaAnnotatedState(1, codecHandle, nil)
+	})
+}
+
+func BenchmarkSortedSliceDfaAnnotatedStateBuild(b *testing.B) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	benchmarkBuildState(b, func() State {
+		return NewSortedSliceDfaAnnotatedState(1, codecHandle, nil)
+	})
+}
@@ -0,0 +1,204 @@
+package wilddawg
+
+import (
+	"hash"
+
+	"github.com/ugorji/go/codec"
+)
+
+/*
+	An EdgeDataState stores a value on each of its outgoing edges, such as
+	the output of a transducer, alongside the annotations of the state
+	itself. Data can only be set on an existing edge, and is removed with the
+	edge. Setting data on an edge that has some overwrites it.
+*/
+type EdgeDataState interface {
+	State
+	SetEdgeData(interface{}, interface{}) error
+	GetEdgeData(interface{}) (interface{}, bool)
+	GetEdgeDataMap() map[interface{}]interface{}
+}
+
+// This implementation extends LazyDfaAnnotatedState with edge data. When
+// HashEdgeData is set, as it is by the constructor, edge data takes part in
+// IsomorphismHash and Equals like key/value annotations do, so states whose
+// edges carry different data never merge. When it is unset, edge data is
+// ignored, and a register may merge states whose edges carry different data,
+// keeping the data of the representative. A state without edge data hashes
+// exactly like a LazyDfaAnnotatedState with the same edges.
+type LazyDfaEdgeDataState struct {
+	*LazyDfaAnnotatedState
+	EdgeData     map[interface{}]interface{}
+	HashEdgeData bool
+}
+
+func NewLazyDfaEdgeDataState(id StateId, encoding codec.Handle,
+	hashFunc hash.Hash32) *LazyDfaEdgeDataState {
+	return NewLazyDfaEdgeDataStateWithCapacity(id, encoding, hashFunc, 0)
+}
+
+// See NewLazyDfaAnnotatedStateWithCapacity.
+func NewLazyDfaEdgeDataStateWithCapacity(id StateId, encoding codec.Handle,
+	hashFunc hash.Hash32, edgeCapacity int) *LazyDfaEdgeDataState {
+	lazyState := NewLazyDfaAnnotatedStateWithCapacity(id, encoding, hashFunc,
+		edgeCapacity)
+	lazyState.Type = LAZYDFAEDGEDATA
+	return &LazyDfaEdgeDataState{
+		LazyDfaAnnotatedState: lazyState,
+		EdgeData:              make(map[interface{}]interface{}),
+		HashEdgeData:          true,
+	}
+}
+
+func (s *LazyDfaEdgeDataState) SetEdgeData(edgeTransition interface{},
+	data interface{}) error {
+	if _, present := s.Edges[edgeTransition]; !present {
+		return ErrEdgeNotPresent
+	}
+	s.EdgeData[edgeTransition] = data
+	return nil
+}
+
+func (s *LazyDfaEdgeDataState) GetEdgeData(edgeTransition interface{}) (
+	interface{}, bool) {
+	data, present := s.EdgeData[edgeTransition]
+	return data, present
+}
+
+func (s *LazyDfaEdgeDataState) GetEdgeDataMap() map[interface{}]interface{} {
+	edgeData := make(map[interface{}]interface{}, len(s.EdgeData))
+	for edge, data := range s.EdgeData {
+		edgeData[edge] = data
+	}
+	return edgeData
+}
+
+// A successful AddEdge can only replace an edge with UnsafeNoDupCheck set,
+// and then the data of the replaced edge is dropped.
+func (s *LazyDfaEdgeDataState) AddEdge(edgeTransition interface{},
+	destination State) error {
+	if err := s.LazyDfaAnnotatedState.AddEdge(edgeTransition,
+		destination); err != nil {
+		return err
+	}
+	delete(s.EdgeData, edgeTransition)
+	return nil
+}
+
+func (s *LazyDfaEdgeDataState) RemoveEdge(edgeTransition interface{},
+	destination State) error {
+	if err := s.LazyDfaAnnotatedState.RemoveEdge(edgeTransition,
+		destination); err != nil {
+		return err
+	}
+	delete(s.EdgeData, edgeTransition)
+	return nil
+}
+
+func (s *LazyDfaEdgeDataState) IsomorphismHash() (interface{}, error) {
+	if !s.HashEdgeData || len(s.EdgeData) == 0 {
+		return s.LazyDfaAnnotatedState.IsomorphismHash()
+	}
+	if s.IncrementalHash {
+		dataHash, err := encodeHashes(s.keyedEdgeData(), s.Encoding,
+			s.HashFunc, s.HashFunc2)
+		if err != nil {
+			return 0, err
+		}
+		if s.HashFunc2 != nil {
+			return combineHashes(s.EdgeHashXor, s.EdgeHashXor2) ^
+				dataHash.(uint64), nil
+		}
+		return s.EdgeHashXor ^ dataHash.(uint32), nil
+	}
+	return encodeHashes([]interface{}{s.keyedMachineEdges(),
+		s.keyedEdgeData()}, s.Encoding, s.HashFunc, s.HashFunc2)
+}
+
+// Two states are equal when their machine edges and the edge data that each
+// hashes are. States without edge data support, or without HashEdgeData set,
+// count as having none, so that equality is symmetric. Key/value annotations
+// are compared as by LazyDfaAnnotatedState.
+func (s *LazyDfaEdgeDataState) Equals(other State) (bool, error) {
+	return s.EqualsWith(other, nil)
+}
+
+func (s *LazyDfaEdgeDataState) EqualsWith(other State,
+	symbolEqual SymbolEqualFunc) (bool, error) {
+	return s.sameEdgesWith(other, symbolEqual) &&
+		sameKVAnnotations(s, other) &&
+		sameHashedEdgeData(s, other, s.TransitionKeyFunc), nil
+}
+
+func (s *LazyDfaEdgeDataState) Clone() State {
+	lazyClone := s.LazyDfaAnnotatedState.Clone().(*LazyDfaAnnotatedState)
+	lazyClone.Type = s.Type
+	clone := &LazyDfaEdgeDataState{
+		LazyDfaAnnotatedState: lazyClone,
+		EdgeData:              s.GetEdgeDataMap(),
+		HashEdgeData:          s.HashEdgeData,
+	}
+	return clone
+}
+
+func (s *LazyDfaEdgeDataState) CloneDeep() State {
+	return cloneDeep(s)
+}
+
+func (s *LazyDfaEdgeDataState) keyedEdgeData() map[interface{}]interface{} {
+	return keyEdgeData(s.EdgeData, s.TransitionKeyFunc)
+}
+
+// Returns edge data with every transition replaced by its key.
+func keyEdgeData(edgeData map[interface{}]interface{},
+	keyFunc TransitionKeyFunc) map[interface{}]interface{} {
+	if keyFunc == nil {
+		return edgeData
+	}
+	keyedData := make(map[interface{}]interface{}, len(edgeData))
+	for edge, data := range edgeData {
+		keyedData[keyFunc(edge)] = data
+	}
+	return keyedData
+}
+
+// Returns the edge data of a state if it takes part in the state's
+// IsomorphismHash, and nil otherwise. Other EdgeDataState implementations are
+// assumed to hash their edge data.
+func hashedEdgeData(state State) map[interface{}]interface{} {
+	switch s := state.(type) {
+	case *LazyDfaEdgeDataState:
+		if s.HashEdgeData {
+			return s.GetEdgeDataMap()
+		}
+	case EdgeDataState:
+		return s.GetEdgeDataMap()
+	}
+	return nil
+}
+
+// Returns whether two states have the same hashed edge data, as returned by
+// hashedEdgeData, with transitions keyed by keyFunc.
+func sameHashedEdgeData(a State, b State, keyFunc TransitionKeyFunc) bool {
+	return sameValues(keyEdgeData(hashedEdgeData(a), keyFunc),
+		keyEdgeData(hashedEdgeData(b), keyFunc))
+}
+
+// Points the edge of a state at a new destination, keeping any data stored on
+// the edge. Rewiring through RemoveEdge and AddEdge alone would drop it.
+func redirectEdge(state State, edgeTransition interface{}, destination,
+	newDestination State) error {
+	var data interface{}
+	dataState, hasData := state.(EdgeDataState)
+	if hasData {
+		data, hasData = dataState.GetEdgeData(edgeTransition)
+	}
+	if err := state.RemoveEdge(edgeTransition, destination); err != nil {
+		return err
+	} else if err := state.AddEdge(edgeTransition, newDestination); err != nil {
+		return err
+	} else if hasData {
+		return dataState.SetEdgeData(edgeTransition, data)
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package wilddawg
+
+import (
+	"hash/fnv"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestLazyDfaEdgeDataStateEdgeData(t *testing.T) {
+	var testState EdgeDataState = NewLazyDfaEdgeDataState(1, nil, nil)
+	destination := NewLazyDfaEdgeDataState(2, nil, nil)
+
+	if err := testState.SetEdgeData("a", "x"); err != ErrEdgeNotPresent {
+		t.Errorf("Expected %q, got %q", ErrEdgeNotPresent, err)
+	}
+	if err := testState.AddEdge("a", destination); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if _, present := testState.GetEdgeData("a"); present {
+		t.Errorf("Expected no edge data on a new edge")
+	}
+	if err := testState.SetEdgeData("a", "x"); err != nil {
+		t.Errorf("Error while setting edge data: %q", err)
+	}
+	if data, present := testState.GetEdgeData("a"); !present {
+		t.Errorf("Expected edge data on \"a\" to be present")
+	} else if data != "x" {
+		t.Errorf("Edge data %v, want x", data)
+	}
+
+	clone := testState.Clone().(EdgeDataState)
+	if err := clone.SetEdgeData("a", "y"); err != nil {
+		t.Errorf("Error while setting edge data: %q", err)
+	}
+	if data, _ := testState.GetEdgeData("a"); data != "x" {
+		t.Errorf("Clone modification changed edge data to %v, want x", data)
+	}
+	if data, _ := clone.GetEdgeData("a"); data != "y" {
+		t.Errorf("Edge data of clone %v, want y", data)
+	}
+
+	if err := testState.RemoveEdge("a", destination); err != nil {
+		t.Errorf("Error while removing edge: %q", err)
+	}
+	if _, present := testState.GetEdgeData("a"); present {
+		t.Errorf("Expected edge data to be removed with the edge")
+	}
+	if stateType := testState.GetStateType(); stateType != LAZYDFAEDGEDATA {
+		t.Errorf("Expected StateType %d, got %d", LAZYDFAEDGEDATA, stateType)
+	}
+}
+
+func TestLazyDfaEdgeDataStateIsomorphism(t *testing.T) {
+	sharedCodecHandle := new(codec.BincHandle)
+	sharedCodecHandle.Canonical = true
+	sharedHashFunc := fnv.New32()
+
+	destination := NewLazyDfaAnnotatedState(1, sharedCodecHandle,
+		sharedHashFunc)
+	plainState := NewLazyDfaAnnotatedState(2, sharedCodecHandle,
+		sharedHashFunc)
+	testStateA := NewLazyDfaEdgeDataState(3, sharedCodecHandle,
+		sharedHashFunc)
+	testStateB := NewLazyDfaEdgeDataState(4, sharedCodecHandle,
+		sharedHashFunc)
+	for _, state := range []State{plainState, testStateA, testStateB} {
+		if err := state.AddEdge("a", destination); err != nil {
+			t.Fatalf("Error while adding edge: %q", err)
+		}
+	}
+
+	plainHash, err := plainState.IsomorphismHash()
+	if err != nil {
+		t.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+	}
+	if hash, err := testStateA.IsomorphismHash(); err != nil {
+		t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+	} else if hash != plainHash {
+		t.Errorf("Expected hash %d without edge data, got %d", plainHash,
+			hash)
+	}
+
+	if err := testStateA.SetEdgeData("a", "x"); err != nil {
+		t.Errorf("Error while setting edge data: %q", err)
+	}
+	if err := testStateB.SetEdgeData("a", "y"); err != nil {
+		t.Errorf("Error while setting edge data: %q", err)
+	}
+	for _, hashEdgeData := range []bool{true, false} {
+		testStateA.HashEdgeData = hashEdgeData
+		testStateB.HashEdgeData = hashEdgeData
+		if a_hash, err := testStateA.IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if b_hash, err := testStateB.IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if (a_hash == b_hash) == hashEdgeData {
+			t.Errorf("With HashEdgeData %t, hashes %d and %d", hashEdgeData,
+				a_hash, b_hash)
+		}
+		if equal, err := testStateA.Equals(testStateB); err != nil {
+			t.Errorf("Error while comparing states: %q", err)
+		} else if equal == hashEdgeData {
+			t.Errorf("With HashEdgeData %t, states equal %t", hashEdgeData,
+				equal)
+		}
+	}
+}
+
+func TestLazyDfaEdgeDataStateEqualsPlainStates(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	destination := NewLazyDfaAnnotatedState(1, codecHandle, fnv.New32())
+	plainStates := []State{
+		NewLazyDfaAnnotatedState(2, codecHandle, fnv.New32()),
+		NewSortedSliceDfaAnnotatedState(3, codecHandle, fnv.New32()),
+		NewHybridDfaAnnotatedState(4, codecHandle, fnv.New32(), 4),
+		NewLazyDfaKVAnnotatedState(5, codecHandle, fnv.New32()),
+	}
+	testState := NewLazyDfaEdgeDataState(6, codecHandle, fnv.New32())
+	for _, state := range append(plainStates, testState) {
+		addTestEdge(t, state, "a", destination)
+	}
+	if err := testState.SetEdgeData("a", "OUT"); err != nil {
+		t.Fatalf("Error while setting edge data: %q", err)
+	}
+
+	for _, hashEdgeData := range []bool{true, false} {
+		testState.HashEdgeData = hashEdgeData
+		for _, plainState := range plainStates {
+			if equal, err := plainState.Equals(testState); err != nil {
+				t.Errorf("Error while comparing states: %q", err)
+			} else if equal == hashEdgeData {
+				t.Errorf("With HashEdgeData %t, state %d equals %t",
+					hashEdgeData, plainState.GetId(), equal)
+			}
+			if equal, err := testState.Equals(plainState); err != nil {
+				t.Errorf("Error while comparing states: %q", err)
+			} else if equal == hashEdgeData {
+				t.Errorf("With HashEdgeData %t, equals state %d %t",
+					hashEdgeData, plainState.GetId(), equal)
+			}
+		}
+	}
+}
+
+func TestLazyDfaEdgeDataStateRewiring(t *testing.T) {
+	factory := newTestStateFactory(t)
+	if err := factory.SetDefaultStateType(LAZYDFAEDGEDATA); err != nil {
+		t.Fatalf("Error while setting default state type: %q", err)
+	}
+	states := newTestStates(t, factory, 3)
+	addTestEdge(t, states[0], "a", states[1])
+	addTestEdge(t, states[1], "b", states[2])
+	if err := states[0].(EdgeDataState).SetEdgeData("a", "x"); err != nil {
+		t.Fatalf("Error while setting edge data: %q", err)
+	}
+
+	deepClone := states[0].(*LazyDfaEdgeDataState).CloneDeep()
+	if data, _ := deepClone.(EdgeDataState).GetEdgeData("a"); data != "x" {
+		t.Errorf("Edge data after CloneDeep %v, want x", data)
+	}
+	if cloneStart, err := CloneMachine(states[0], factory, nil); err != nil {
+		t.Errorf("Error while cloning machine: %q", err)
+	} else if data, _ := cloneStart.(EdgeDataState).GetEdgeData(
+		"a"); data != "x" {
+		t.Errorf("Edge data after CloneMachine %v, want x", data)
+	}
+
+	if err := Relabel(states[0], func(edge interface{}) (interface{},
+		error) {
+		return edge.(string) + edge.(string), nil
+	}); err != nil {
+		t.Fatalf("Error while relabeling: %q", err)
+	}
+	if data, _ := states[0].(EdgeDataState).GetEdgeData("aa"); data != "x" {
+		t.Errorf("Edge data after Relabel %v, want x", data)
+	}
+}
+
+func TestLazyDfaEdgeDataStateMachineHash(t *testing.T) {
+	machineHashes := make(map[bool][]uint64)
+	for _, hashEdgeData := range []bool{true, false} {
+		for _, output := range []string{"X", "Y"} {
+			factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+			factory.HashEdgeData = hashEdgeData
+			if err := factory.SetDefaultStateType(
+				LAZYDFAEDGEDATA); err != nil {
+				t.Fatalf("Error while setting default state type: %q", err)
+			}
+			states := newTestStates(t, factory, 2)
+			addTestEdge(t, states[0], "a", states[1])
+			if err := states[0].(EdgeDataState).SetEdgeData("a",
+				output); err != nil {
+				t.Fatalf("Error while setting edge data: %q", err)
+			}
+			if machineHash, err := MachineHash(states[0]); err != nil {
+				t.Errorf("Error while hashing machine: %q", err)
+			} else {
+				machineHashes[hashEdgeData] = append(
+					machineHashes[hashEdgeData], machineHash)
+			}
+		}
+	}
+	if hashes := machineHashes[true]; len(hashes) != 2 ||
+		hashes[0] == hashes[1] {
+		t.Errorf("Expected different outputs to hash differently: %v",
+			hashes)
+	}
+	if hashes := machineHashes[false]; len(hashes) != 2 ||
+		hashes[0] != hashes[1] {
+		t.Errorf("Expected unhashed edge data to be ignored: %v", hashes)
+	}
+}
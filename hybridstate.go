@@ -0,0 +1,340 @@
+package wilddawg
+
+import (
+	"hash"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	DefaultSmallEdgeLimit = 4
+)
+
+// This implementation keeps up to SmallEdgeLimit edges in a slice searched
+// linearly, and moves them into a map once a state needs more. Most states of a
+// DAWG have only a few outgoing edges, and for those a short slice takes much
+// less memory than a map, at a small cost in lookup time from comparing
+// transitions as interface values. A state that has been promoted to a map
+// keeps it even if edges are later removed. The map is allocated with room for
+// EdgeCapacityHint edges if that is more than the state needs at promotion. It
+// hashes identically to LazyDfaAnnotatedState and supports the same
+// IncrementalHash, SharedEncoder, SymbolTable, TransitionKeyFunc and HashFunc2
+// options, so the two can share a register.
+type HybridDfaAnnotatedState struct {
+	Id                StateId
+	SmallEdges        []EdgePair
+	Edges             map[interface{}]State
+	SmallEdgeLimit    int
+	EdgeCapacityHint  int
+	Encoding          codec.Handle
+	HashFunc          hash.Hash32
+	HashFunc2         hash.Hash32
+	Annotations       map[interface{}]bool
+	UserData          map[interface{}]interface{}
+	IncrementalHash   bool
+	EdgeHashXor       uint32
+	EdgeHashXor2      uint32
+	SharedEncoder     *ReusableEncoder
+	SymbolTable       *SymbolTable
+	TransitionKeyFunc TransitionKeyFunc
+	Type              StateType
+}
+
+func NewHybridDfaAnnotatedState(id StateId, encoding codec.Handle,
+	hashFunc hash.Hash32, smallEdgeLimit int) *HybridDfaAnnotatedState {
+	return &HybridDfaAnnotatedState{
+		Id:                id,
+		SmallEdges:        nil,
+		Edges:             nil,
+		SmallEdgeLimit:    smallEdgeLimit,
+		EdgeCapacityHint:  0,
+		Encoding:          encoding,
+		HashFunc:          hashFunc,
+		HashFunc2:         nil,
+		Type:              HYBRIDDFAANNOTATED,
+		Annotations:       make(map[interface{}]bool),
+		UserData:          nil,
+		IncrementalHash:   false,
+		EdgeHashXor:       0,
+		EdgeHashXor2:      0,
+		SharedEncoder:     nil,
+		SymbolTable:       nil,
+		TransitionKeyFunc: nil,
+	}
+}
+
+func (s *HybridDfaAnnotatedState) GetId() StateId {
+	return s.Id
+}
+
+func (s *HybridDfaAnnotatedState) SetId(id StateId) error {
+	s.Id = id
+	return nil
+}
+
+func (s *HybridDfaAnnotatedState) AddAnnotation(annotation interface{}) error {
+	s.Annotations[annotation] = true
+	return nil
+}
+
+func (s *HybridDfaAnnotatedState) RemoveAnnotation(
+	annotation interface{}) error {
+	if _, present := s.Annotations[annotation]; !present {
+		return ErrAnnotationInvalid
+	}
+	delete(s.Annotations, annotation)
+	return nil
+}
+
+func (s *HybridDfaAnnotatedState) GetAnnotations() ([]interface{}, error) {
+	annotationList := make([]interface{}, 0, len(s.Annotations))
+	for annotation := range s.Annotations {
+		annotationList = append(annotationList, annotation)
+	}
+	return annotationList, nil
+}
+
+func (s *HybridDfaAnnotatedState) SetUserData(key interface{},
+	value interface{}) {
+	if s.UserData == nil {
+		s.UserData = make(map[interface{}]interface{})
+	}
+	s.UserData[key] = value
+}
+
+func (s *HybridDfaAnnotatedState) GetUserData(key interface{}) (interface{},
+	bool) {
+	value, present := s.UserData[key]
+	return value, present
+}
+
+func (s *HybridDfaAnnotatedState) AddEdge(edgeTransition interface{},
+	destination State) error {
+	if _, present := s.findEdge(edgeTransition); present {
+		return ErrEdgeAlreadyUsed
+	}
+	if s.SymbolTable != nil {
+		edgeTransition = s.SymbolTable.Intern(edgeTransition)
+	}
+	if s.IncrementalHash {
+		edgeHash, edgeHash2, err := encodeEdgeHash(transitionKey(
+			edgeTransition, s.TransitionKeyFunc), destination.GetId(),
+			s.Encoding, s.HashFunc, s.HashFunc2)
+		if err != nil {
+			return err
+		}
+		s.EdgeHashXor ^= edgeHash
+		s.EdgeHashXor2 ^= edgeHash2
+	}
+
+	if s.Edges == nil && len(s.SmallEdges) < s.SmallEdgeLimit {
+		if s.SmallEdges == nil {
+			s.SmallEdges = make([]EdgePair, 0, s.SmallEdgeLimit)
+		}
+		s.SmallEdges = append(s.SmallEdges, EdgePair{
+			Transition:  edgeTransition,
+			Destination: destination,
+		})
+		return nil
+	}
+	if s.Edges == nil {
+		edgeCapacity := len(s.SmallEdges) + 1
+		if s.EdgeCapacityHint > edgeCapacity {
+			edgeCapacity = s.EdgeCapacityHint
+		}
+		s.Edges = make(map[interface{}]State, edgeCapacity)
+		for _, edge := range s.SmallEdges {
+			s.Edges[edge.Transition] = edge.Destination
+		}
+		s.SmallEdges = nil
+	}
+	s.Edges[edgeTransition] = destination
+	return nil
+}
+
+func (s *HybridDfaAnnotatedState) RemoveEdge(edgeTransition interface{},
+	destination State) error {
+	if edgeTo, present := s.findEdge(edgeTransition); !present {
+		return ErrEdgeNotPresent
+	} else if edgeTo != destination {
+		return ErrEdgeNotPresent
+	}
+	if s.IncrementalHash {
+		edgeHash, edgeHash2, err := encodeEdgeHash(transitionKey(
+			edgeTransition, s.TransitionKeyFunc), destination.GetId(),
+			s.Encoding, s.HashFunc, s.HashFunc2)
+		if err != nil {
+			return err
+		}
+		s.EdgeHashXor ^= edgeHash
+		s.EdgeHashXor2 ^= edgeHash2
+	}
+
+	if s.Edges != nil {
+		delete(s.Edges, edgeTransition)
+		return nil
+	}
+	for i, edge := range s.SmallEdges {
+		if edge.Transition == edgeTransition {
+			s.SmallEdges = append(s.SmallEdges[:i], s.SmallEdges[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *HybridDfaAnnotatedState) FollowEdge(
+	edgeTransition interface{}) []State {
+	destinationStates := make([]State, 0)
+	if destination, present := s.findEdge(edgeTransition); present {
+		destinationStates = append(destinationStates, destination)
+	}
+	return destinationStates
+}
+
+func (s *HybridDfaAnnotatedState) FollowAllEdges() []State {
+	uniqueDestinations := make(map[State]bool)
+	destinationStates := make([]State, 0)
+	for _, edge := range s.edgePairs() {
+		if _, seen := uniqueDestinations[edge.Destination]; !seen {
+			uniqueDestinations[edge.Destination] = true
+			destinationStates = append(destinationStates, edge.Destination)
+		}
+	}
+	return destinationStates
+}
+
+func (s *HybridDfaAnnotatedState) EdgesTo(destination State) []interface{} {
+	edgeTransitions := make([]interface{}, 0)
+	for _, edge := range s.edgePairs() {
+		if edge.Destination == destination {
+			edgeTransitions = append(edgeTransitions, edge.Transition)
+		}
+	}
+	return edgeTransitions
+}
+
+func (s *HybridDfaAnnotatedState) MachineEdges() map[interface{}]StateId {
+	edges := s.edgePairs()
+	machineEdges := make(map[interface{}]StateId, len(edges))
+	for _, edge := range edges {
+		machineEdges[edge.Transition] = edge.Destination.GetId()
+	}
+	return machineEdges
+}
+
+func (s *HybridDfaAnnotatedState) keyedMachineEdges() map[interface{}]StateId {
+	return keyEdges(s.MachineEdges(), s.TransitionKeyFunc)
+}
+
+func (s *HybridDfaAnnotatedState) StableEdges() []EdgePair {
+	edgePairs := s.edgePairs()
+	sortEdgePairs(edgePairs, s.Encoding)
+	return edgePairs
+}
+
+func (s *HybridDfaAnnotatedState) IsomorphismHash() (interface{}, error) {
+	if s.IncrementalHash {
+		return incrementalHash(s.EdgeHashXor, s.EdgeHashXor2, s.HashFunc2),
+			nil
+	}
+	if s.SharedEncoder != nil {
+		return s.SharedEncoder.hashes(s.keyedMachineEdges(), s.HashFunc,
+			s.HashFunc2)
+	}
+	return encodeHashes(s.keyedMachineEdges(), s.Encoding, s.HashFunc,
+		s.HashFunc2)
+}
+
+// Two states are equal when their machine edges are. Annotations and user data
+// are not compared, matching IsomorphismHash, but a state with key/value
+// annotations or hashed edge data never equals this one, so that equality is
+// symmetric.
+func (s *HybridDfaAnnotatedState) Equals(other State) (bool, error) {
+	return s.EqualsWith(other, nil)
+}
+
+func (s *HybridDfaAnnotatedState) EqualsWith(other State,
+	symbolEqual SymbolEqualFunc) (bool, error) {
+	if other == nil {
+		return false, nil
+	}
+	return sameMachineEdgesWith(s.keyedMachineEdges(),
+		keyEdges(other.MachineEdges(), s.TransitionKeyFunc), symbolEqual) &&
+		sameKVAnnotations(s, other) &&
+		sameHashedEdgeData(s, other, s.TransitionKeyFunc), nil
+}
+
+func (s *HybridDfaAnnotatedState) Clone() State {
+	clone := NewHybridDfaAnnotatedState(s.Id, s.Encoding, s.HashFunc,
+		s.SmallEdgeLimit)
+	clone.HashFunc2 = s.HashFunc2
+	clone.EdgeCapacityHint = s.EdgeCapacityHint
+	if s.SmallEdges != nil {
+		clone.SmallEdges = make([]EdgePair, len(s.SmallEdges),
+			cap(s.SmallEdges))
+		copy(clone.SmallEdges, s.SmallEdges)
+	}
+	if s.Edges != nil {
+		clone.Edges = make(map[interface{}]State, len(s.Edges))
+		for edge, destination := range s.Edges {
+			clone.Edges[edge] = destination
+		}
+	}
+	for annotation, placeholder := range s.Annotations {
+		clone.Annotations[annotation] = placeholder
+	}
+	for key, value := range s.UserData {
+		clone.SetUserData(key, value)
+	}
+	clone.IncrementalHash = s.IncrementalHash
+	clone.EdgeHashXor = s.EdgeHashXor
+	clone.EdgeHashXor2 = s.EdgeHashXor2
+	clone.SharedEncoder = s.SharedEncoder
+	clone.SymbolTable = s.SymbolTable
+	clone.TransitionKeyFunc = s.TransitionKeyFunc
+	return clone
+}
+
+func (s *HybridDfaAnnotatedState) CloneDeep() State {
+	return cloneDeep(s)
+}
+
+func (s *HybridDfaAnnotatedState) GetStateType() StateType {
+	return s.Type
+}
+
+func (s *HybridDfaAnnotatedState) String() string {
+	return formatState(s)
+}
+
+func (s *HybridDfaAnnotatedState) findEdge(
+	edgeTransition interface{}) (State, bool) {
+	if s.Edges != nil {
+		destination, present := s.Edges[edgeTransition]
+		return destination, present
+	}
+	for _, edge := range s.SmallEdges {
+		if edge.Transition == edgeTransition {
+			return edge.Destination, true
+		}
+	}
+	return nil, false
+}
+
+// Returns the edges as a new slice, whichever way they are stored.
+func (s *HybridDfaAnnotatedState) edgePairs() []EdgePair {
+	if s.Edges == nil {
+		edgePairs := make([]EdgePair, len(s.SmallEdges))
+		copy(edgePairs, s.SmallEdges)
+		return edgePairs
+	}
+	edgePairs := make([]EdgePair, 0, len(s.Edges))
+	for edge, destination := range s.Edges {
+		edgePairs = append(edgePairs, EdgePair{
+			Transition:  edge,
+			Destination: destination,
+		})
+	}
+	return edgePairs
+}
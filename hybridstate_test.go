@@ -0,0 +1,154 @@
+package wilddawg
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func newTestHybridStateFactory(t testing.TB,
+	smallEdgeLimit int) StateFactory {
+	factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+	if err := factory.SetDefaultStateType(HYBRIDDFAANNOTATED); err != nil {
+		t.Fatalf("Error while setting default state type: %q", err)
+	}
+	factory.SmallEdgeLimit = smallEdgeLimit
+	return factory
+}
+
+func TestHybridDfaAnnotatedStateEdge(t *testing.T) {
+	states := newTestStates(t, newTestHybridStateFactory(t, 2), 3)
+	hybridState := states[0].(*HybridDfaAnnotatedState)
+
+	addTestEdge(t, hybridState, "a", states[1])
+	addTestEdge(t, hybridState, "b", states[2])
+	if hybridState.Edges != nil || len(hybridState.SmallEdges) != 2 {
+		t.Errorf("Expected 2 edges in slice, got %v and %v",
+			hybridState.SmallEdges, hybridState.Edges)
+	}
+	if err := hybridState.AddEdge("a", states[2]); err != ErrEdgeAlreadyUsed {
+		t.Errorf("Expected %q, got %q", ErrEdgeAlreadyUsed, err)
+	}
+
+	addTestEdge(t, hybridState, "c", states[1])
+	if hybridState.SmallEdges != nil || len(hybridState.Edges) != 3 {
+		t.Errorf("Expected 3 edges in map, got %v and %v",
+			hybridState.SmallEdges, hybridState.Edges)
+	}
+	expected := map[interface{}]StateId{
+		"a": states[1].GetId(),
+		"b": states[2].GetId(),
+		"c": states[1].GetId(),
+	}
+	if edges := hybridState.MachineEdges(); !sameMachineEdges(edges,
+		expected) {
+		t.Errorf("Expected %v, got %v", expected, edges)
+	}
+	if edges := hybridState.EdgesTo(states[1]); !slicesSameValues(edges,
+		[]interface{}{"a", "c"}) {
+		t.Errorf("Expected [a c], got %v", edges)
+	}
+	if dest := hybridState.FollowAllEdges(); len(dest) != 2 {
+		t.Errorf("Destination state count %d (%v), want 2", len(dest), dest)
+	}
+
+	if err := hybridState.RemoveEdge("a", states[2]); err != ErrEdgeNotPresent {
+		t.Errorf("Expected %q, got %q", ErrEdgeNotPresent, err)
+	}
+	for _, edge := range []interface{}{"a", "c"} {
+		if err := hybridState.RemoveEdge(edge, states[1]); err != nil {
+			t.Errorf("Error while removing edge: %q", err)
+		}
+	}
+	if dest := hybridState.FollowEdge("b"); len(dest) != 1 ||
+		dest[0] != states[2] {
+		t.Errorf("Expected %v, got %v", states[2], dest)
+	}
+	if dest := hybridState.FollowEdge("a"); len(dest) != 0 {
+		t.Errorf("Destination state count %d, want 0", len(dest))
+	}
+}
+
+func TestHybridDfaAnnotatedStateMatchesLazy(t *testing.T) {
+	words := newRandomTestWords(300)
+	lazyStart := newTestTrie(t, newTestStateFactory(t), words)
+	hybridStart := newTestTrie(t, newTestHybridStateFactory(t, 2), words)
+
+	if lazyString, hybridString := MachineString(lazyStart),
+		MachineString(hybridStart); lazyString != hybridString {
+		t.Errorf("Expected machines to match:\n%s\n%s", lazyString,
+			hybridString)
+	}
+
+	lazyStates := OrderedStates(lazyStart)
+	hybridStates := OrderedStates(hybridStart)
+	for i, hybridState := range hybridStates {
+		if hybridState.GetStateType() != HYBRIDDFAANNOTATED {
+			t.Errorf("State %d type %d, want %d", hybridState.GetId(),
+				hybridState.GetStateType(), HYBRIDDFAANNOTATED)
+		}
+		if lazyHash, err := lazyStates[i].IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if hybridHash, err := hybridState.IsomorphismHash(); err !=
+			nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if lazyHash != hybridHash {
+			t.Errorf("State %d hash %d, want %d", hybridState.GetId(),
+				hybridHash, lazyHash)
+		}
+		if equal, err := hybridState.Equals(lazyStates[i]); err != nil {
+			t.Errorf("Error while comparing states: %q", err)
+		} else if !equal {
+			t.Errorf("Expected state %d to equal its lazy counterpart",
+				hybridState.GetId())
+		}
+	}
+
+	lazyCount, err := DistinctSuffixes(lazyStart)
+	if err != nil {
+		t.Fatalf("Error while counting distinct suffixes: %q", err)
+	}
+	if hybridCount, err := DistinctSuffixes(hybridStart); err != nil {
+		t.Errorf("Error while counting distinct suffixes: %q", err)
+	} else if hybridCount != lazyCount {
+		t.Errorf("Distinct suffixes %d, want %d", hybridCount, lazyCount)
+	}
+}
+
+func BenchmarkHybridDfaAnnotatedStateFollowEdge(b *testing.B) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	benchmarkFollowEdge(b, NewHybridDfaAnnotatedState(1, codecHandle, nil,
+		DefaultSmallEdgeLimit), NewHybridDfaAnnotatedState(2, codecHandle,
+		nil, DefaultSmallEdgeLimit))
+}
+
+// Reports the heap retained per state of a trie over the random test words.
+func benchmarkTrieMemory(b *testing.B, stateType StateType) {
+	words := newRandomTestWords(2000)
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		factory := newTestStateFactory(b)
+		if err := factory.SetDefaultStateType(stateType); err != nil {
+			b.Fatalf("Error while setting default state type: %q", err)
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		startState := newTestTrie(b, factory, words)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		stateCount := factory.GetIdCounter()
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/
+			float64(stateCount), "bytes/state")
+		runtime.KeepAlive(startState)
+	}
+}
+
+func BenchmarkLazyDfaAnnotatedStateTrieMemory(b *testing.B) {
+	benchmarkTrieMemory(b, LAZYDFAANNOTATED)
+}
+
+func BenchmarkHybridDfaAnnotatedStateTrieMemory(b *testing.B) {
+	benchmarkTrieMemory(b, HYBRIDDFAANNOTATED)
+}
@@ -0,0 +1,138 @@
+package wilddawg
+
+import (
+	"hash"
+
+	"github.com/ugorji/go/codec"
+)
+
+/*
+	A KVAnnotatedState holds key/value annotations, such as a frequency or
+	lemma for the word ending at the state, alongside the set-style
+	annotations of State. Adding a value under an existing key overwrites it.
+*/
+type KVAnnotatedState interface {
+	State
+	AddAnnotationKV(interface{}, interface{}) error
+	GetAnnotationKV(interface{}) (interface{}, bool)
+	RemoveAnnotationKV(interface{}) error
+	GetAnnotationKVs() map[interface{}]interface{}
+}
+
+// This implementation extends LazyDfaAnnotatedState with key/value
+// annotations. Unlike set-style annotations and user data, key/value
+// annotations are payloads that must survive minimization, so they take part
+// in IsomorphismHash and Equals: states carrying different values never
+// merge. A state without key/value annotations hashes exactly like a
+// LazyDfaAnnotatedState with the same edges.
+type LazyDfaKVAnnotatedState struct {
+	*LazyDfaAnnotatedState
+	KVAnnotations map[interface{}]interface{}
+}
+
+func NewLazyDfaKVAnnotatedState(id StateId, encoding codec.Handle,
+	hashFunc hash.Hash32) *LazyDfaKVAnnotatedState {
+	return NewLazyDfaKVAnnotatedStateWithCapacity(id, encoding, hashFunc, 0)
+}
+
+// See NewLazyDfaAnnotatedStateWithCapacity.
+func NewLazyDfaKVAnnotatedStateWithCapacity(id StateId,
+	encoding codec.Handle, hashFunc hash.Hash32,
+	edgeCapacity int) *LazyDfaKVAnnotatedState {
+	lazyState := NewLazyDfaAnnotatedStateWithCapacity(id, encoding, hashFunc,
+		edgeCapacity)
+	lazyState.Type = LAZYDFAKVANNOTATED
+	return &LazyDfaKVAnnotatedState{
+		LazyDfaAnnotatedState: lazyState,
+		KVAnnotations:         make(map[interface{}]interface{}),
+	}
+}
+
+func (s *LazyDfaKVAnnotatedState) AddAnnotationKV(key interface{},
+	value interface{}) error {
+	s.KVAnnotations[key] = value
+	return nil
+}
+
+func (s *LazyDfaKVAnnotatedState) GetAnnotationKV(key interface{}) (
+	interface{}, bool) {
+	value, present := s.KVAnnotations[key]
+	return value, present
+}
+
+func (s *LazyDfaKVAnnotatedState) RemoveAnnotationKV(key interface{}) error {
+	if _, present := s.KVAnnotations[key]; !present {
+		return ErrAnnotationInvalid
+	}
+	delete(s.KVAnnotations, key)
+	return nil
+}
+
+func (s *LazyDfaKVAnnotatedState) GetAnnotationKVs() (
+	kvAnnotations map[interface{}]interface{}) {
+	kvAnnotations = make(map[interface{}]interface{}, len(s.KVAnnotations))
+	for key, value := range s.KVAnnotations {
+		kvAnnotations[key] = value
+	}
+	return kvAnnotations
+}
+
+func (s *LazyDfaKVAnnotatedState) IsomorphismHash() (interface{}, error) {
+	if len(s.KVAnnotations) == 0 {
+		return s.LazyDfaAnnotatedState.IsomorphismHash()
+	}
+	if s.IncrementalHash {
+		kvHash, err := encodeHashes(s.KVAnnotations, s.Encoding, s.HashFunc,
+			s.HashFunc2)
+		if err != nil {
+			return 0, err
+		}
+		if s.HashFunc2 != nil {
+			return combineHashes(s.EdgeHashXor, s.EdgeHashXor2) ^
+				kvHash.(uint64), nil
+		}
+		return s.EdgeHashXor ^ kvHash.(uint32), nil
+	}
+	return encodeHashes([]interface{}{s.keyedMachineEdges(), s.KVAnnotations},
+		s.Encoding, s.HashFunc, s.HashFunc2)
+}
+
+// Two states are equal when their machine edges and key/value annotations
+// are. States without key/value support count as having none.
+func (s *LazyDfaKVAnnotatedState) Equals(other State) (bool, error) {
+	return s.EqualsWith(other, nil)
+}
+
+func (s *LazyDfaKVAnnotatedState) EqualsWith(other State,
+	symbolEqual SymbolEqualFunc) (bool, error) {
+	return s.sameEdgesWith(other, symbolEqual) &&
+		sameKVAnnotations(s, other) &&
+		sameHashedEdgeData(s, other, s.TransitionKeyFunc), nil
+}
+
+func (s *LazyDfaKVAnnotatedState) Clone() State {
+	lazyClone := s.LazyDfaAnnotatedState.Clone().(*LazyDfaAnnotatedState)
+	lazyClone.Type = s.Type
+	clone := &LazyDfaKVAnnotatedState{
+		LazyDfaAnnotatedState: lazyClone,
+		KVAnnotations:         s.GetAnnotationKVs(),
+	}
+	return clone
+}
+
+func (s *LazyDfaKVAnnotatedState) CloneDeep() State {
+	return cloneDeep(s)
+}
+
+// Returns whether two states have the same key/value annotations. States
+// without key/value support count as having none, whichever side they are on.
+func sameKVAnnotations(a State, b State) bool {
+	var aKVAnnotations, bKVAnnotations map[interface{}]interface{}
+	if kvState, ok := a.(KVAnnotatedState); ok {
+		aKVAnnotations = kvState.GetAnnotationKVs()
+	}
+	if kvState, ok := b.(KVAnnotatedState); ok {
+		bKVAnnotations = kvState.GetAnnotationKVs()
+	}
+	return sameValues(aKVAnnotations, bKVAnnotations)
+}
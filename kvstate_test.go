@@ -0,0 +1,116 @@
+package wilddawg
+
+import (
+	"hash/fnv"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestLazyDfaKVAnnotatedStateAnnotationKV(t *testing.T) {
+	var testState KVAnnotatedState = NewLazyDfaKVAnnotatedState(1, nil, nil)
+
+	if _, present := testState.GetAnnotationKV("freq"); present {
+		t.Errorf("Expected no key/value annotations on initialization")
+	}
+	if err := testState.AddAnnotationKV("freq", 3); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if value, present := testState.GetAnnotationKV("freq"); !present {
+		t.Errorf("Expected annotation \"freq\" to be present")
+	} else if value != 3 {
+		t.Errorf("Annotation value %v, want 3", value)
+	}
+	if err := testState.AddAnnotationKV("freq", 5); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if value, _ := testState.GetAnnotationKV("freq"); value != 5 {
+		t.Errorf("Annotation value %v after overwrite, want 5", value)
+	}
+
+	if err := testState.AddAnnotation("noun"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if annotations, err := testState.GetAnnotations(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if !slicesSameValues(annotations, []interface{}{"noun"}) {
+		t.Errorf("GetAnnotations() returned %v, want [noun]", annotations)
+	}
+
+	if err := testState.RemoveAnnotationKV("freq"); err != nil {
+		t.Errorf("Error while removing annotation: %q", err)
+	}
+	if _, present := testState.GetAnnotationKV("freq"); present {
+		t.Errorf("Expected annotation \"freq\" to be removed")
+	}
+	if err := testState.RemoveAnnotationKV(
+		"freq"); err != ErrAnnotationInvalid {
+		t.Errorf("Expected %q, got %q", ErrAnnotationInvalid, err)
+	}
+
+	if stateType := testState.GetStateType(); stateType != LAZYDFAKVANNOTATED {
+		t.Errorf("Expected StateType %d, got %d", LAZYDFAKVANNOTATED,
+			stateType)
+	}
+}
+
+func TestLazyDfaKVAnnotatedStateIsomorphism(t *testing.T) {
+	sharedCodecHandle := new(codec.BincHandle)
+	sharedCodecHandle.Canonical = true
+	sharedHashFunc := fnv.New32()
+
+	plainState := NewLazyDfaAnnotatedState(1, sharedCodecHandle,
+		sharedHashFunc)
+	testStateA := NewLazyDfaKVAnnotatedState(2, sharedCodecHandle,
+		sharedHashFunc)
+	testStateB := NewLazyDfaKVAnnotatedState(3, sharedCodecHandle,
+		sharedHashFunc)
+
+	plainHash, err := plainState.IsomorphismHash()
+	if err != nil {
+		t.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+	}
+	if hash, err := testStateA.IsomorphismHash(); err != nil {
+		t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+	} else if hash != plainHash {
+		t.Errorf("Expected hash %d without annotations, got %d", plainHash,
+			hash)
+	}
+
+	if err := testStateA.AddAnnotationKV("lemma", "run"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if err := testStateB.AddAnnotationKV("lemma", "walk"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if a_hash, err := testStateA.IsomorphismHash(); err != nil {
+		t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+	} else if b_hash, err := testStateB.IsomorphismHash(); err != nil {
+		t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+	} else if a_hash == b_hash {
+		t.Errorf("Expected different hashes for different values: %d",
+			a_hash)
+	}
+	if equal, err := testStateA.Equals(testStateB); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if equal {
+		t.Errorf("Expected states with different values to differ")
+	}
+
+	testStateC := testStateA.Clone().(*LazyDfaKVAnnotatedState)
+	if equal, err := testStateA.Equals(testStateC); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if !equal {
+		t.Errorf("Expected clone to equal original")
+	}
+	if err := testStateC.AddAnnotationKV("lemma", "ran"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if value, _ := testStateA.GetAnnotationKV("lemma"); value != "run" {
+		t.Errorf("Clone modification changed value to %v, want run", value)
+	}
+	if stateType := testStateC.GetStateType(); stateType != LAZYDFAKVANNOTATED {
+		t.Errorf("Expected StateType %d, got %d", LAZYDFAKVANNOTATED,
+			stateType)
+	}
+}
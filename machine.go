@@ -0,0 +1,602 @@
+package wilddawg
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+var (
+	ErrNilDestination  = errors.New("Edge leads to a nil state")
+	ErrStateIdMismatch = errors.New("State Id does not match the Id " +
+		"recorded by its parent")
+	ErrUnregisteredState = errors.New("State is missing from its " +
+		"equivalence class bucket")
+	ErrCyclicMachine    = errors.New("State machine contains a cycle")
+	ErrRelabelCollision = errors.New("Relabeling maps two transitions of " +
+		"a state to the same symbol")
+)
+
+/*
+	Machine-level helpers operate on the state machine reachable from some
+	start state. They traverse the machine without modifying it unless stated
+	otherwise.
+*/
+
+// Returns the number of incoming edges for every state reachable from the
+// start state. Heavily shared suffix states have a high in-degree. The start
+// state is included with an in-degree of zero unless an edge leads back to it.
+func InDegreeMap(startState State) map[StateId]int {
+	inDegrees := make(map[StateId]int)
+	if startState == nil {
+		return inDegrees
+	}
+
+	inDegrees[startState.GetId()] = 0
+	seenStates := map[StateId]bool{startState.GetId(): true}
+	stack := []State{startState}
+	for len(stack) != 0 {
+		curr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		for _, destId := range curr.MachineEdges() {
+			inDegrees[destId] += 1
+		}
+
+		for _, next := range curr.FollowAllEdges() {
+			nextId := next.GetId()
+			if _, seen := seenStates[nextId]; !seen {
+				stack = append(stack, next)
+				seenStates[nextId] = true
+			}
+		}
+	}
+
+	return inDegrees
+}
+
+// Walks the machine reachable from the start state and reports every
+// inconsistency found rather than stopping at the first one. Edges to nil
+// states, distinct states sharing the Id recorded by a parent's machine edges
+// and, if the register given is a ContainingRegister, states missing from
+// their isomorphism hash bucket are reported. Each returned error names the
+// offending state and wraps the underlying error. States with nil edges are
+// neither hashed nor traversed further.
+func Validate(startState State, register Register) []error {
+	problems := make([]error, 0)
+	if startState == nil {
+		return problems
+	}
+
+	statesById := map[StateId]State{startState.GetId(): startState}
+	stack := []State{startState}
+	for len(stack) != 0 {
+		curr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		currId := curr.GetId()
+
+		hasNilDestination := false
+		for _, next := range curr.FollowAllEdges() {
+			if next == nil {
+				problems = append(problems, fmt.Errorf("state %d: %w", currId,
+					ErrNilDestination))
+				hasNilDestination = true
+			}
+		}
+		if hasNilDestination {
+			continue
+		}
+
+		if containingRegister, ok := register.(ContainingRegister); ok {
+			var hashErr *RegisterHashError
+			present, err := containingRegister.ContainsState(curr)
+			if errors.As(err, &hashErr) {
+				problems = append(problems, err)
+			} else if err != nil {
+				problems = append(problems, fmt.Errorf("state %d: %w", currId,
+					err))
+			} else if !present {
+				problems = append(problems, fmt.Errorf("state %d: %w", currId,
+					ErrUnregisteredState))
+			}
+		}
+
+		for edge, nextId := range curr.MachineEdges() {
+			for _, next := range curr.FollowEdge(edge) {
+				if seen, present := statesById[nextId]; !present {
+					statesById[nextId] = next
+					stack = append(stack, next)
+				} else if seen != next || next.GetId() != nextId {
+					problems = append(problems, fmt.Errorf(
+						"state %d edge %v to state %d: %w", currId, edge,
+						nextId, ErrStateIdMismatch))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// Returns every state reachable from the start state in ascending StateId
+// order, giving a stable order for serialization and golden tests.
+func OrderedStates(startState State) []State {
+	orderedStates := make([]State, 0)
+	if startState == nil {
+		return orderedStates
+	}
+
+	seenStates := map[StateId]bool{startState.GetId(): true}
+	stack := []State{startState}
+	for len(stack) != 0 {
+		curr := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		orderedStates = append(orderedStates, curr)
+
+		for _, next := range curr.FollowAllEdges() {
+			nextId := next.GetId()
+			if _, seen := seenStates[nextId]; !seen {
+				stack = append(stack, next)
+				seenStates[nextId] = true
+			}
+		}
+	}
+
+	sort.Slice(orderedStates, func(i, j int) bool {
+		return orderedStates[i].GetId() < orderedStates[j].GetId()
+	})
+	return orderedStates
+}
+
+// Returns the states whose shortest distance from the start state is exactly
+// depth edges, in ascending StateId order. Depth 0 is the start state itself.
+// With suffix sharing a state can be reached by paths of several lengths; it
+// is only returned at the shortest of them.
+func StatesAtDepth(startState State, depth int) []State {
+	layer := make([]State, 0)
+	if startState == nil || depth < 0 {
+		return layer
+	}
+
+	layer = append(layer, startState)
+	seenStates := map[StateId]bool{startState.GetId(): true}
+	for currDepth := 0; currDepth < depth && len(layer) != 0; currDepth++ {
+		nextLayer := make([]State, 0)
+		for _, curr := range layer {
+			for _, next := range curr.FollowAllEdges() {
+				nextId := next.GetId()
+				if _, seen := seenStates[nextId]; !seen {
+					nextLayer = append(nextLayer, next)
+					seenStates[nextId] = true
+				}
+			}
+		}
+		layer = nextLayer
+	}
+
+	sort.Slice(layer, func(i, j int) bool {
+		return layer[i].GetId() < layer[j].GetId()
+	})
+	return layer
+}
+
+// Removes the annotation from every state reachable from the start state that
+// has it, e.g. to clear a mark left by an earlier pass, and returns the number
+// of states it was removed from.
+func ClearAnnotation(startState State, annotation interface{}) int {
+	removed := 0
+	for _, state := range OrderedStates(startState) {
+		if err := state.RemoveAnnotation(annotation); err == nil {
+			removed += 1
+		}
+	}
+	return removed
+}
+
+// Returns how many edges of the machine reachable from the start state use
+// each transition symbol. Edges are counted in the graph itself, so a symbol
+// on a shared suffix counts once no matter how many words pass through it.
+func SymbolFrequency(startState State) map[interface{}]int {
+	frequencies := make(map[interface{}]int)
+	for _, state := range OrderedStates(startState) {
+		for edge := range state.MachineEdges() {
+			frequencies[edge] += 1
+		}
+	}
+	return frequencies
+}
+
+// Returns the number of structurally distinct states reachable from the start
+// state, i.e. the number of states the machine would have once minimized. It
+// equals the reachable state count exactly when the machine is minimal. The
+// machine must be acyclic, otherwise ErrCyclicMachine is returned.
+func DistinctSuffixes(startState State) (int, error) {
+	representatives, err := equivalenceRepresentatives(startState)
+	if err != nil {
+		return 0, err
+	}
+	distinctIds := make(map[StateId]bool)
+	for _, representative := range representatives {
+		distinctIds[representative.GetId()] = true
+	}
+	return len(distinctIds), nil
+}
+
+// Returns the groups of distinct reachable states that are equivalent and
+// would be merged by minimizing the machine, each as sorted Ids, with groups
+// sorted by their first Id. An empty result means the machine is already
+// minimal. The machine must be acyclic, otherwise ErrCyclicMachine is
+// returned.
+func FindMergeableStates(startState State) ([][]StateId, error) {
+	representatives, err := equivalenceRepresentatives(startState)
+	if err != nil {
+		return nil, err
+	}
+	classes := make(map[StateId][]StateId)
+	for id, representative := range representatives {
+		representativeId := representative.GetId()
+		classes[representativeId] = append(classes[representativeId], id)
+	}
+
+	mergeable := make([][]StateId, 0)
+	for _, class := range classes {
+		if len(class) < 2 {
+			continue
+		}
+		sort.Slice(class, func(i, j int) bool {
+			return class[i] < class[j]
+		})
+		mergeable = append(mergeable, class)
+	}
+	sort.Slice(mergeable, func(i, j int) bool {
+		return mergeable[i][0] < mergeable[j][0]
+	})
+	return mergeable, nil
+}
+
+// Maps the Id of every state reachable from the start state to the
+// representative of its equivalence class in a fresh register. States are
+// visited in post-order, and each one is registered as a clone whose edges
+// lead to its destinations' representatives, so equivalent subgraphs collapse
+// even when the machine itself is not minimal. The machine is not modified.
+func equivalenceRepresentatives(startState State) (map[StateId]State,
+	error) {
+	representatives := make(map[StateId]State)
+	if startState == nil {
+		return representatives, nil
+	}
+
+	type frame struct {
+		state    State
+		expanded bool
+	}
+	register := NewCollisionSafeHashMapRegister()
+	onPath := make(map[StateId]bool)
+	stack := []frame{{state: startState}}
+	for len(stack) != 0 {
+		curr := &stack[len(stack)-1]
+		currId := curr.state.GetId()
+
+		if !curr.expanded {
+			if _, done := representatives[currId]; done {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			curr.expanded = true
+			onPath[currId] = true
+			state := curr.state
+			for _, next := range state.FollowAllEdges() {
+				nextId := next.GetId()
+				if onPath[nextId] {
+					return nil, ErrCyclicMachine
+				} else if _, done := representatives[nextId]; !done {
+					stack = append(stack, frame{state: next})
+				}
+			}
+			continue
+		}
+
+		stack = stack[:len(stack)-1]
+		onPath[currId] = false
+		clone := curr.state.Clone()
+		for edge, destId := range curr.state.MachineEdges() {
+			destination := curr.state.FollowEdge(edge)[0]
+			representative := representatives[destId]
+			if representative == destination {
+				continue
+			}
+			if err := redirectEdge(clone, edge, destination,
+				representative); err != nil {
+				return nil, err
+			}
+		}
+		if ref, err := register.GetEquivalenceClass(clone); err != nil {
+			return nil, err
+		} else {
+			representatives[currId] = ref
+		}
+	}
+
+	return representatives, nil
+}
+
+// Returns the start state of an independent copy of the machine reachable from
+// the start state. Every state is cloned through the factory, so the copy gets
+// fresh Ids, and its edges are rewired to the cloned destinations. If a
+// register is given, it is initialized from the copy.
+func CloneMachine(startState State, factory StateFactory,
+	register Register) (State, error) {
+	if startState == nil {
+		return nil, ErrRegisterNilState
+	}
+
+	originalStates := OrderedStates(startState)
+	clones := make(map[StateId]State, len(originalStates))
+	for _, state := range originalStates {
+		if clone, err := factory.CloneState(state); err != nil {
+			return nil, err
+		} else {
+			clones[state.GetId()] = clone
+		}
+	}
+
+	for _, state := range originalStates {
+		clone := clones[state.GetId()]
+		for edge, destId := range state.MachineEdges() {
+			destination := state.FollowEdge(edge)[0]
+			if err := redirectEdge(clone, edge, destination,
+				clones[destId]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cloneStart := clones[startState.GetId()]
+	if register != nil {
+		if err := register.Initialize(cloneStart); err != nil {
+			return nil, err
+		}
+	}
+	return cloneStart, nil
+}
+
+// Reports whether no state reachable from the start state follows any of its
+// transitions to more than one destination. LazyDfaAnnotatedState is
+// deterministic by construction, so this only fails for nondeterministic
+// State implementations. The package has no epsilon transitions.
+func IsDeterministic(startState State) bool {
+	for _, state := range OrderedStates(startState) {
+		for edge := range state.MachineEdges() {
+			if len(state.FollowEdge(edge)) > 1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Rewrites the transition symbol of every edge reachable from the start state
+// through the mapping, e.g. to replace runes with small integers for a dense
+// alphabet. All mapped symbols are computed and checked before any edge is
+// changed, so if the mapping fails or sends two transitions of one state to
+// the same symbol the machine is left untouched. A collision is reported as
+// ErrRelabelCollision, wrapped with the offending state. Any register holding
+// states of the machine must be initialized again afterwards.
+func Relabel(startState State,
+	mapping func(interface{}) (interface{}, error)) error {
+	type relabeledEdge struct {
+		oldTransition interface{}
+		newTransition interface{}
+		destination   State
+		data          interface{}
+		hasData       bool
+	}
+
+	states := OrderedStates(startState)
+	relabeledEdges := make([][]relabeledEdge, len(states))
+	for i, state := range states {
+		newTransitions := make(map[interface{}]bool)
+		for edge := range state.MachineEdges() {
+			newTransition, err := mapping(edge)
+			if err != nil {
+				return err
+			} else if newTransitions[newTransition] {
+				return fmt.Errorf("state %d: %w", state.GetId(),
+					ErrRelabelCollision)
+			}
+			newTransitions[newTransition] = true
+			var data interface{}
+			dataState, hasData := state.(EdgeDataState)
+			if hasData {
+				data, hasData = dataState.GetEdgeData(edge)
+			}
+			relabeledEdges[i] = append(relabeledEdges[i], relabeledEdge{
+				oldTransition: edge,
+				newTransition: newTransition,
+				destination:   state.FollowEdge(edge)[0],
+				data:          data,
+				hasData:       hasData,
+			})
+		}
+	}
+
+	for i, state := range states {
+		for _, edge := range relabeledEdges[i] {
+			if err := state.RemoveEdge(edge.oldTransition,
+				edge.destination); err != nil {
+				return err
+			}
+		}
+		for _, edge := range relabeledEdges[i] {
+			if err := state.AddEdge(edge.newTransition,
+				edge.destination); err != nil {
+				return err
+			} else if edge.hasData {
+				if err := state.(EdgeDataState).SetEdgeData(
+					edge.newTransition, edge.data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns a shortest sequence of transitions that can be followed from one of
+// the two states but not from the other, found by a breadth-first search over
+// pairs of states reached by the same input. This explains why two states did
+// not merge. Without terminal states, two states are told apart only by the
+// paths leading out of them: annotations and key/value annotations are not
+// compared. The last symbol of the sequence is the one missing on one side;
+// ties are broken by StableEdges order. If no such sequence exists, false is
+// returned.
+func DistinguishingSuffix(a State, b State) ([]interface{}, bool) {
+	if a == nil || b == nil {
+		return nil, false
+	}
+
+	type statePair struct {
+		a    State
+		b    State
+		path []interface{}
+	}
+	type pairId struct {
+		a StateId
+		b StateId
+	}
+	seenPairs := map[pairId]bool{{a.GetId(), b.GetId()}: true}
+	queue := []statePair{{a: a, b: b}}
+	for len(queue) != 0 {
+		curr := queue[0]
+		queue = queue[1:]
+
+		edgesA, edgesB := curr.a.MachineEdges(), curr.b.MachineEdges()
+		for _, edges := range [][]EdgePair{curr.a.StableEdges(),
+			curr.b.StableEdges()} {
+			for _, edge := range edges {
+				_, inA := edgesA[edge.Transition]
+				_, inB := edgesB[edge.Transition]
+				if !inA || !inB {
+					return extendPath(curr.path, edge.Transition), true
+				}
+			}
+		}
+
+		for _, edge := range curr.a.StableEdges() {
+			nextA := edge.Destination
+			nextB := curr.b.FollowEdge(edge.Transition)[0]
+			id := pairId{nextA.GetId(), nextB.GetId()}
+			if seenPairs[id] {
+				continue
+			}
+			seenPairs[id] = true
+			queue = append(queue, statePair{
+				a:    nextA,
+				b:    nextB,
+				path: extendPath(curr.path, edge.Transition),
+			})
+		}
+	}
+	return nil, false
+}
+
+// Returns a copy of the path with the symbol appended, so that paths sharing a
+// prefix never share a backing array.
+func extendPath(path []interface{}, symbol interface{}) []interface{} {
+	extended := make([]interface{}, len(path), len(path)+1)
+	copy(extended, path)
+	return append(extended, symbol)
+}
+
+// Returns the destination of the edge for the symbol out of the given state,
+// first creating it through the factory and adding the edge if the state has
+// no such edge. This shortens building machines by hand.
+func AddTransition(factory StateFactory, from State, symbol interface{}) (
+	State, error) {
+	if from == nil {
+		return nil, ErrRegisterNilState
+	}
+	if destinations := from.FollowEdge(symbol); len(destinations) != 0 {
+		return destinations[0], nil
+	}
+	destination, err := factory.NewState()
+	if err != nil {
+		return nil, err
+	}
+	if err := from.AddEdge(symbol, destination); err != nil {
+		return nil, err
+	}
+	return destination, nil
+}
+
+// Returns a single hash over the machine reachable from the start state, for
+// a cheap first-pass comparison of two machines. States are numbered densely
+// in breadth-first order from the start state, following StableEdges, so the
+// hash does not depend on the Ids the states were built with: structurally
+// equal machines hash alike however they were built. The machine's edges,
+// with the type name of each transition so that e.g. int(1) and int64(1) are
+// told apart, the key/value annotations of states that have them and the edge
+// data of states that hash it are encoded canonically in that order and
+// hashed with 64-bit FNV-1a. Set-style annotations are not included, matching
+// IsomorphismHash.
+func MachineHash(startState State) (uint64, error) {
+	hashFunc := fnv.New64a()
+	if startState == nil {
+		return hashFunc.Sum64(), nil
+	}
+
+	canonicalIds := map[StateId]int{startState.GetId(): 0}
+	queue := []State{startState}
+	encodedStates := make([]interface{}, 0)
+	for len(queue) != 0 {
+		curr := queue[0]
+		queue = queue[1:]
+
+		edges := curr.StableEdges()
+		encodedEdges := make([]interface{}, 0, 3*len(edges))
+		for _, edge := range edges {
+			nextId := edge.Destination.GetId()
+			if _, seen := canonicalIds[nextId]; !seen {
+				canonicalIds[nextId] = len(canonicalIds)
+				queue = append(queue, edge.Destination)
+			}
+			encodedEdges = append(encodedEdges, edge.Transition,
+				fmt.Sprintf("%T", edge.Transition), canonicalIds[nextId])
+		}
+		var kvAnnotations map[interface{}]interface{}
+		if kvState, ok := curr.(KVAnnotatedState); ok {
+			kvAnnotations = kvState.GetAnnotationKVs()
+		}
+		encodedStates = append(encodedStates, []interface{}{encodedEdges,
+			kvAnnotations, hashedEdgeData(curr)})
+	}
+
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	encoded := make([]byte, 0, 64)
+	encoder := codec.NewEncoderBytes(&encoded, codecHandle)
+	if err := encoder.Encode(encodedStates); err != nil {
+		return 0, err
+	}
+	if _, err := hashFunc.Write(encoded); err != nil {
+		return 0, err
+	}
+	return hashFunc.Sum64(), nil
+}
+
+// Returns a compact textual description of the machine reachable from the
+// start state, one line per state in ascending Id order. Each line lists the
+// state's Id, its annotations and its edges in StableEdges order as
+// "symbol->destId", so the output is deterministic and suitable for golden
+// tests.
+func MachineString(startState State) string {
+	lines := make([]string, 0)
+	for _, state := range OrderedStates(startState) {
+		lines = append(lines, formatState(state))
+	}
+	return strings.Join(lines, "\n")
+}
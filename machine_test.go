@@ -0,0 +1,644 @@
+package wilddawg
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+func newTestStateFactory(t testing.TB) StateFactory {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	factory, err := NewEncodeHashStateFactory(codecHandle, fnv.New32(),
+		LAZYDFAANNOTATED)
+	if err != nil {
+		t.Fatalf("Error while creating state factory: %q", err)
+	}
+	return factory
+}
+
+func newTestStates(t testing.TB, factory StateFactory, count int) []State {
+	states := make([]State, 0, count)
+	for i := 0; i < count; i++ {
+		if state, err := factory.NewState(); err != nil {
+			t.Fatalf("Error while creating state: %q", err)
+		} else {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+func addTestEdge(t testing.TB, from State, edge interface{}, to State) {
+	if err := from.AddEdge(edge, to); err != nil {
+		t.Fatalf("Error while adding edge %v: %q", edge, err)
+	}
+}
+
+// Builds the unminimized trie for the given words, one symbol per rune, and
+// returns its start state.
+func newTestTrie(t testing.TB, factory StateFactory, words []string) State {
+	startState := newTestStates(t, factory, 1)[0]
+	for _, word := range words {
+		curr := startState
+		for _, symbol := range word {
+			if next := curr.FollowEdge(symbol); len(next) != 0 {
+				curr = next[0]
+			} else {
+				next := newTestStates(t, factory, 1)[0]
+				addTestEdge(t, curr, symbol, next)
+				curr = next
+			}
+		}
+	}
+	return startState
+}
+
+// Builds the minimal machine for {"cat", "bat"}. The returned slice holds the
+// start state, the shared "at" suffix state, the "t" suffix state and the
+// final state, in that order.
+func newCatBatMachine(t *testing.T) []State {
+	states := newTestStates(t, newTestStateFactory(t), 4)
+	addTestEdge(t, states[0], "c", states[1])
+	addTestEdge(t, states[0], "b", states[1])
+	addTestEdge(t, states[1], "a", states[2])
+	addTestEdge(t, states[2], "t", states[3])
+	return states
+}
+
+func TestInDegreeMap(t *testing.T) {
+	states := newCatBatMachine(t)
+
+	expected := map[StateId]int{
+		states[0].GetId(): 0,
+		states[1].GetId(): 2,
+		states[2].GetId(): 1,
+		states[3].GetId(): 1,
+	}
+	inDegrees := InDegreeMap(states[0])
+	if len(inDegrees) != len(expected) {
+		t.Errorf("Expected %d states, got %d (%v)", len(expected),
+			len(inDegrees), inDegrees)
+	}
+	for id, degree := range expected {
+		if inDegrees[id] != degree {
+			t.Errorf("State %d in-degree %d, want %d", id, inDegrees[id],
+				degree)
+		}
+	}
+
+	if inDegrees := InDegreeMap(nil); len(inDegrees) != 0 {
+		t.Errorf("Expected empty in-degree map for nil state, got %v",
+			inDegrees)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	states := newCatBatMachine(t)
+	register := NewCollisionSafeHashMapRegister()
+	if err := register.Initialize(states[0]); err != nil {
+		t.Fatalf("Error while initializing register: %q", err)
+	}
+
+	if problems := Validate(states[0], register); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+	if problems := Validate(nil, nil); len(problems) != 0 {
+		t.Errorf("Expected no problems for nil state, got %v", problems)
+	}
+
+	if err := states[3].AddEdge("s", nil); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if problems := Validate(states[0], nil); len(problems) != 1 {
+		t.Errorf("Expected 1 problem, got %v", problems)
+	} else if !errors.Is(problems[0], ErrNilDestination) {
+		t.Errorf("Expected %q, got %q", ErrNilDestination, problems[0])
+	}
+	if err := states[3].RemoveEdge("s", nil); err != nil {
+		t.Errorf("Error while removing edge: %q", err)
+	}
+
+	if err := states[2].SetId(states[1].GetId()); err != nil {
+		t.Errorf("Error while trying to set Id: %q", err)
+	}
+	if problems := Validate(states[0], nil); len(problems) != 1 {
+		t.Errorf("Expected 1 problem, got %v", problems)
+	} else if !errors.Is(problems[0], ErrStateIdMismatch) {
+		t.Errorf("Expected %q, got %q", ErrStateIdMismatch, problems[0])
+	}
+}
+
+func TestValidateRegister(t *testing.T) {
+	states := newCatBatMachine(t)
+	register := NewCollisionSafeHashMapRegister()
+	if err := register.Initialize(states[0]); err != nil {
+		t.Fatalf("Error while initializing register: %q", err)
+	}
+
+	addTestEdge(t, states[2], "s", states[3])
+	problems := Validate(states[0], register)
+	if len(problems) != 1 {
+		t.Errorf("Expected 1 problem, got %v", problems)
+	} else if !errors.Is(problems[0], ErrUnregisteredState) {
+		t.Errorf("Expected %q, got %q", ErrUnregisteredState, problems[0])
+	}
+
+	// A register that cannot report its states is not checked.
+	opaqueRegister := struct{ Register }{register}
+	if problems := Validate(states[0], opaqueRegister); len(problems) != 0 {
+		t.Errorf("Expected no problems, got %v", problems)
+	}
+}
+
+func TestOrderedStates(t *testing.T) {
+	states := newCatBatMachine(t)
+	if err := states[0].SetId(9); err != nil {
+		t.Errorf("Error while trying to set Id: %q", err)
+	}
+	if err := states[2].SetId(4); err != nil {
+		t.Errorf("Error while trying to set Id: %q", err)
+	}
+
+	orderedStates := OrderedStates(states[0])
+	if numStates := len(InDegreeMap(states[0])); len(orderedStates) !=
+		numStates {
+		t.Errorf("State count %d, want %d", len(orderedStates), numStates)
+	}
+	expected := []State{states[1], states[3], states[2], states[0]}
+	for i, state := range orderedStates {
+		if i > 0 && orderedStates[i-1].GetId() >= state.GetId() {
+			t.Errorf("States out of order: %d before %d",
+				orderedStates[i-1].GetId(), state.GetId())
+		}
+		if i < len(expected) && state != expected[i] {
+			t.Errorf("State %d at position %d, want state %d",
+				state.GetId(), i, expected[i].GetId())
+		}
+	}
+
+	if orderedStates := OrderedStates(nil); len(orderedStates) != 0 {
+		t.Errorf("Expected no states for nil state, got %v", orderedStates)
+	}
+}
+
+func TestStatesAtDepth(t *testing.T) {
+	startState := newTestTrie(t, newTestStateFactory(t), []string{"cat",
+		"cats", "bat", "do"})
+	rootDestinations := startState.FollowAllEdges()
+	sort.Slice(rootDestinations, func(i, j int) bool {
+		return rootDestinations[i].GetId() < rootDestinations[j].GetId()
+	})
+	if layer := StatesAtDepth(startState, 1); !reflect.DeepEqual(layer,
+		rootDestinations) {
+		t.Errorf("Expected %v, got %v", rootDestinations, layer)
+	}
+	if layer := StatesAtDepth(startState, 0); len(layer) != 1 ||
+		layer[0] != startState {
+		t.Errorf("Expected only the start state, got %v", layer)
+	}
+	if layer := StatesAtDepth(startState, 4); len(layer) != 1 {
+		t.Errorf("Expected one state at depth 4, got %v", layer)
+	}
+	if layer := StatesAtDepth(startState, 5); len(layer) != 0 {
+		t.Errorf("Expected no states at depth 5, got %v", layer)
+	}
+
+	// The final state is reachable at depth 3 through "at" and at depth 1
+	// through "x", but only counts at the depth of its shortest path.
+	states := newCatBatMachine(t)
+	addTestEdge(t, states[0], "x", states[3])
+	if layer := StatesAtDepth(states[0], 1); len(layer) != 2 {
+		t.Errorf("Expected two states at depth 1, got %v", layer)
+	}
+	if layer := StatesAtDepth(states[0], 3); len(layer) != 0 {
+		t.Errorf("Expected no states at depth 3, got %v", layer)
+	}
+}
+
+func TestSymbolFrequency(t *testing.T) {
+	states := newTestStates(t, newTestStateFactory(t), 3)
+	addTestEdge(t, states[0], "a", states[1])
+	addTestEdge(t, states[1], "a", states[2])
+	addTestEdge(t, states[1], "b", states[2])
+
+	expected := map[interface{}]int{"a": 2, "b": 1}
+	frequencies := SymbolFrequency(states[0])
+	if len(frequencies) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, frequencies)
+	}
+	for symbol, count := range expected {
+		if frequencies[symbol] != count {
+			t.Errorf("Symbol %v count %d, want %d", symbol,
+				frequencies[symbol], count)
+		}
+	}
+}
+
+// Builds the unminimized trie for {"cat", "bat"}, which has a separate "at"
+// suffix under each first letter.
+func newCatBatTrie(t *testing.T) []State {
+	states := newTestStates(t, newTestStateFactory(t), 7)
+	addTestEdge(t, states[0], "c", states[1])
+	addTestEdge(t, states[1], "a", states[2])
+	addTestEdge(t, states[2], "t", states[3])
+	addTestEdge(t, states[0], "b", states[4])
+	addTestEdge(t, states[4], "a", states[5])
+	addTestEdge(t, states[5], "t", states[6])
+	return states
+}
+
+func TestDistinctSuffixes(t *testing.T) {
+	minimal := newCatBatMachine(t)
+	if count, err := DistinctSuffixes(minimal[0]); err != nil {
+		t.Errorf("Error while counting distinct suffixes: %q", err)
+	} else if count != len(minimal) {
+		t.Errorf("Distinct suffixes %d, want %d", count, len(minimal))
+	}
+
+	trie := newCatBatTrie(t)
+	if count, err := DistinctSuffixes(trie[0]); err != nil {
+		t.Errorf("Error while counting distinct suffixes: %q", err)
+	} else if count != len(minimal) {
+		t.Errorf("Distinct suffixes %d, want %d", count, len(minimal))
+	}
+	if numStates := len(InDegreeMap(trie[0])); numStates == len(minimal) {
+		t.Errorf("Expected trie to be non-minimal, got %d states", numStates)
+	}
+
+	addTestEdge(t, trie[3], "s", trie[0])
+	if _, err := DistinctSuffixes(trie[0]); err != ErrCyclicMachine {
+		t.Errorf("Expected %q, got %q", ErrCyclicMachine, err)
+	}
+}
+
+func TestCloneMachine(t *testing.T) {
+	factory := newTestStateFactory(t)
+	states := newCatBatMachine(t)
+	if err := factory.SetIdCounter(100); err != nil {
+		t.Fatalf("Error while setting Id counter: %q", err)
+	}
+
+	register := NewCollisionSafeHashMapRegister()
+	cloneStart, err := CloneMachine(states[0], factory, register)
+	if err != nil {
+		t.Fatalf("Error while cloning machine: %q", err)
+	}
+
+	originalIds := make(map[StateId]bool)
+	for _, state := range states {
+		originalIds[state.GetId()] = true
+	}
+	cloneStates := OrderedStates(cloneStart)
+	if len(cloneStates) != len(states) {
+		t.Errorf("Clone state count %d, want %d", len(cloneStates),
+			len(states))
+	}
+	for _, state := range cloneStates {
+		if originalIds[state.GetId()] {
+			t.Errorf("Clone reuses original state Id %d", state.GetId())
+		}
+		if present, err := register.ContainsState(state); err != nil {
+			t.Errorf("Error while checking state: %q", err)
+		} else if !present {
+			t.Errorf("Cloned state %d missing from register", state.GetId())
+		}
+	}
+	if count, err := DistinctSuffixes(cloneStart); err != nil {
+		t.Errorf("Error while counting distinct suffixes: %q", err)
+	} else if count != len(states) {
+		t.Errorf("Clone distinct suffixes %d, want %d", count, len(states))
+	}
+
+	cloneSuffix := cloneStart.FollowEdge("c")[0]
+	if cloneSuffix != cloneStart.FollowEdge("b")[0] {
+		t.Errorf("Expected clone to keep the shared suffix state")
+	}
+	addTestEdge(t, cloneSuffix, "u", cloneSuffix.FollowEdge("a")[0])
+	addTestEdge(t, cloneStart, "d", cloneSuffix)
+
+	if edges := states[0].MachineEdges(); len(edges) != 2 {
+		t.Errorf("Original start state has %d edges, want 2", len(edges))
+	}
+	if edges := states[1].MachineEdges(); len(edges) != 1 {
+		t.Errorf("Original suffix state has %d edges, want 1", len(edges))
+	}
+	if numStates := len(OrderedStates(states[0])); numStates != len(states) {
+		t.Errorf("Original state count %d, want %d", numStates, len(states))
+	}
+}
+
+func TestMachineString(t *testing.T) {
+	states := newCatBatMachine(t)
+	if err := states[3].AddAnnotation("end"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+
+	expected := "0: b->1 c->1\n" +
+		"1: a->2\n" +
+		"2: t->3\n" +
+		"3 {end}:"
+	if machineString := MachineString(states[0]); machineString != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, machineString)
+	}
+	if machineString := MachineString(nil); machineString != "" {
+		t.Errorf("Expected empty string for nil state, got %q",
+			machineString)
+	}
+}
+
+// A nondeterministic test state whose extra edges share transitions with its
+// regular edges.
+type testNfaState struct {
+	*LazyDfaAnnotatedState
+	extraEdges map[interface{}][]State
+}
+
+func (s *testNfaState) FollowEdge(edgeTransition interface{}) []State {
+	return append(s.LazyDfaAnnotatedState.FollowEdge(edgeTransition),
+		s.extraEdges[edgeTransition]...)
+}
+
+func (s *testNfaState) FollowAllEdges() []State {
+	destinationStates := s.LazyDfaAnnotatedState.FollowAllEdges()
+	for _, destinations := range s.extraEdges {
+		destinationStates = append(destinationStates, destinations...)
+	}
+	return destinationStates
+}
+
+func TestIsDeterministic(t *testing.T) {
+	states := newCatBatMachine(t)
+	if !IsDeterministic(states[0]) {
+		t.Errorf("Expected DFA to be deterministic")
+	}
+
+	nfaStart := &testNfaState{
+		LazyDfaAnnotatedState: NewLazyDfaAnnotatedState(10, nil, nil),
+		extraEdges:            make(map[interface{}][]State),
+	}
+	addTestEdge(t, nfaStart, "c", states[1])
+	if !IsDeterministic(nfaStart) {
+		t.Errorf("Expected NFA without duplicate transitions to be " +
+			"deterministic")
+	}
+	nfaStart.extraEdges["c"] = []State{states[2]}
+	if IsDeterministic(nfaStart) {
+		t.Errorf("Expected NFA with duplicate transition to be " +
+			"nondeterministic")
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	words := []string{"cat", "bat", "cab"}
+	startState := newTestTrie(t, newTestStateFactory(t), words)
+	toIndex := func(symbol interface{}) (interface{}, error) {
+		return int(symbol.(rune) - 'a'), nil
+	}
+	if err := Relabel(startState, toIndex); err != nil {
+		t.Fatalf("Error while relabeling: %q", err)
+	}
+
+	for _, word := range words {
+		curr := startState
+		for _, symbol := range word {
+			if next := curr.FollowEdge(int(symbol - 'a')); len(next) != 1 {
+				t.Fatalf("Expected %q to be accepted via mapped symbols",
+					word)
+			} else {
+				curr = next[0]
+			}
+		}
+	}
+	if next := startState.FollowEdge('c'); len(next) != 0 {
+		t.Errorf("Expected original symbol to be removed, got %v", next)
+	}
+
+	before := MachineString(startState)
+	collapse := func(symbol interface{}) (interface{}, error) {
+		return 0, nil
+	}
+	if err := Relabel(startState, collapse); !errors.Is(err,
+		ErrRelabelCollision) {
+		t.Errorf("Expected %q, got %q", ErrRelabelCollision, err)
+	}
+	if after := MachineString(startState); after != before {
+		t.Errorf("Expected machine to be unchanged, got %q", after)
+	}
+}
+
+func TestDistinguishingSuffix(t *testing.T) {
+	factory := newTestStateFactory(t)
+	catsStart := newTestTrie(t, factory, []string{"cat", "cats", "car"})
+	catStart := newTestTrie(t, factory, []string{"cat", "car"})
+
+	if suffix, found := DistinguishingSuffix(catsStart,
+		catStart); !found {
+		t.Errorf("Expected machines to be distinguished")
+	} else if !reflect.DeepEqual(suffix, []interface{}{'c', 'a', 't',
+		's'}) {
+		t.Errorf("Expected suffix [c a t s], got %v", suffix)
+	}
+	if suffix, found := DistinguishingSuffix(catStart,
+		catsStart); !found || len(suffix) != 4 {
+		t.Errorf("Expected suffix of length 4, got %v", suffix)
+	}
+
+	otherCatStart := newTestTrie(t, factory, []string{"car", "cat"})
+	if suffix, found := DistinguishingSuffix(catStart,
+		otherCatStart); found {
+		t.Errorf("Expected equivalent machines, got suffix %v", suffix)
+	}
+
+	states := newCatBatMachine(t)
+	if suffix, found := DistinguishingSuffix(states[1], states[2]); !found {
+		t.Errorf("Expected states to be distinguished")
+	} else if !reflect.DeepEqual(suffix, []interface{}{"a"}) {
+		t.Errorf("Expected suffix [a], got %v", suffix)
+	}
+}
+
+func TestMachineHash(t *testing.T) {
+	factory := newTestStateFactory(t)
+	words := []string{"cat", "cats", "car", "bat"}
+	startA := newTestTrie(t, factory, words)
+	startB := newTestTrie(t, factory, []string{"bat", "car", "cats",
+		"cat"})
+	if startA.FollowEdge('c')[0].GetId() == startB.FollowEdge(
+		'c')[0].GetId() {
+		t.Fatalf("Expected builds to assign different Ids")
+	}
+
+	hashA, err := MachineHash(startA)
+	if err != nil {
+		t.Fatalf("Error while computing machine hash: %q", err)
+	}
+	if hashB, err := MachineHash(startB); err != nil {
+		t.Errorf("Error while computing machine hash: %q", err)
+	} else if hashA != hashB {
+		t.Errorf("Expected equal machines to hash alike: %d, %d", hashA,
+			hashB)
+	}
+
+	startC := newTestTrie(t, factory, append(words, "cab"))
+	if hashC, err := MachineHash(startC); err != nil {
+		t.Errorf("Error while computing machine hash: %q", err)
+	} else if hashA == hashC {
+		t.Errorf("Expected different machines to hash differently")
+	}
+}
+
+func TestMachineHashTransitionsEncodingAlike(t *testing.T) {
+	factory := newTestStateFactory(t)
+	transitions := make([]interface{}, 0, 16)
+	for i := 0; i < 8; i++ {
+		transitions = append(transitions, i, int64(i))
+	}
+	// Builds a start state with an edge on each transition, inserted in the
+	// given order, to a state whose only edge is on the transition's index.
+	newMachine := func(order []int) State {
+		states := newTestStates(t, factory, len(transitions)+2)
+		for _, i := range order {
+			addTestEdge(t, states[0], transitions[i], states[i+1])
+			addTestEdge(t, states[i+1], i, states[len(states)-1])
+		}
+		return states[0]
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	expected, err := MachineHash(newMachine(rng.Perm(len(transitions))))
+	if err != nil {
+		t.Fatalf("Error while computing machine hash: %q", err)
+	}
+	for i := 0; i < 50; i++ {
+		if hash, err := MachineHash(newMachine(
+			rng.Perm(len(transitions)))); err != nil {
+			t.Errorf("Error while computing machine hash: %q", err)
+		} else if hash != expected {
+			t.Errorf("Expected equal machines to hash alike: %d, %d",
+				expected, hash)
+		}
+	}
+
+	hashes := make(map[uint64]bool)
+	for _, transition := range []interface{}{1, int64(1), int8(1)} {
+		states := newTestStates(t, factory, 2)
+		addTestEdge(t, states[0], transition, states[1])
+		if hash, err := MachineHash(states[0]); err != nil {
+			t.Errorf("Error while computing machine hash: %q", err)
+		} else if hashes[hash] {
+			t.Errorf("Expected different machines to hash differently")
+		} else {
+			hashes[hash] = true
+		}
+	}
+}
+
+func TestClearAnnotation(t *testing.T) {
+	states := newCatBatMachine(t)
+	for _, state := range states[1:] {
+		if err := state.AddAnnotation("visited"); err != nil {
+			t.Errorf("Error while adding annotation: %q", err)
+		}
+	}
+	if err := states[3].AddAnnotation("end"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+
+	if removed := ClearAnnotation(states[0], "visited"); removed != 3 {
+		t.Errorf("Removed count %d, want 3", removed)
+	}
+	for _, state := range states {
+		if annotations, err := state.GetAnnotations(); err != nil {
+			t.Errorf("Error while getting annotations: %q", err)
+		} else {
+			for _, annotation := range annotations {
+				if annotation == "visited" {
+					t.Errorf("State %d still annotated", state.GetId())
+				}
+			}
+		}
+	}
+	if annotations, err := states[3].GetAnnotations(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if !slicesSameValues(annotations, []interface{}{"end"}) {
+		t.Errorf("Expected annotations [end], got %v", annotations)
+	}
+
+	if removed := ClearAnnotation(states[0], "visited"); removed != 0 {
+		t.Errorf("Removed count %d, want 0", removed)
+	}
+	if removed := ClearAnnotation(nil, "visited"); removed != 0 {
+		t.Errorf("Removed count %d, want 0", removed)
+	}
+}
+
+func TestAddTransition(t *testing.T) {
+	factory := newTestStateFactory(t)
+	startState := newTestStates(t, factory, 1)[0]
+
+	chain := []State{startState}
+	for _, symbol := range []interface{}{"c", "a", "t"} {
+		if next, err := AddTransition(factory, chain[len(chain)-1],
+			symbol); err != nil {
+			t.Fatalf("Error while adding transition: %q", err)
+		} else {
+			chain = append(chain, next)
+		}
+	}
+	if stateCount := len(OrderedStates(startState)); stateCount != 4 {
+		t.Errorf("State count %d, want 4", stateCount)
+	}
+
+	curr := startState
+	for i, symbol := range []interface{}{"c", "a", "r"} {
+		next, err := AddTransition(factory, curr, symbol)
+		if err != nil {
+			t.Fatalf("Error while adding transition: %q", err)
+		}
+		if i < 2 && next != chain[i+1] {
+			t.Errorf("Expected existing edge %v to be reused", symbol)
+		} else if i == 2 && next == chain[i+1] {
+			t.Errorf("Expected new state for edge %v", symbol)
+		}
+		curr = next
+	}
+	if stateCount := len(OrderedStates(startState)); stateCount != 5 {
+		t.Errorf("State count %d, want 5", stateCount)
+	}
+
+	if _, err := AddTransition(factory, nil, "c"); err != ErrRegisterNilState {
+		t.Errorf("Expected %q, got %q", ErrRegisterNilState, err)
+	}
+}
+
+func TestFindMergeableStates(t *testing.T) {
+	minimal := newCatBatMachine(t)
+	if mergeable, err := FindMergeableStates(minimal[0]); err != nil {
+		t.Errorf("Error while finding mergeable states: %q", err)
+	} else if len(mergeable) != 0 {
+		t.Errorf("Expected no mergeable states, got %v", mergeable)
+	}
+
+	trie := newCatBatTrie(t)
+	expected := [][]StateId{
+		{trie[1].GetId(), trie[4].GetId()},
+		{trie[2].GetId(), trie[5].GetId()},
+		{trie[3].GetId(), trie[6].GetId()},
+	}
+	if mergeable, err := FindMergeableStates(trie[0]); err != nil {
+		t.Errorf("Error while finding mergeable states: %q", err)
+	} else if !reflect.DeepEqual(mergeable, expected) {
+		t.Errorf("Expected %v, got %v", expected, mergeable)
+	}
+
+	addTestEdge(t, trie[3], "s", trie[0])
+	if _, err := FindMergeableStates(trie[0]); err != ErrCyclicMachine {
+		t.Errorf("Expected %q, got %q", ErrCyclicMachine, err)
+	}
+}
@@ -0,0 +1,233 @@
+package wilddawg
+
+import (
+	"errors"
+)
+
+var (
+	ErrUnsupportedHash = errors.New("IsomorphismHash is not an unsigned " +
+		"integer")
+)
+
+const (
+	openAddressingInitialSize = 16
+	fibonacciHashMultiplier   = 0x9E3779B97F4A7C15
+)
+
+type OpenAddressingSlot struct {
+	Hash  uint64
+	State State
+}
+
+// This implementation of Register stores representatives in a single
+// power-of-two sized table and resolves collisions by linear probing, comparing
+// candidates with Equals. It avoids the per-bucket slices of
+// CollisionSafeHashMapRegister, but requires states whose IsomorphismHash is an
+// unsigned integer. Removal shifts later entries of a probe run back instead
+// of leaving tombstones. SymbolEqual works as in CollisionSafeHashMapRegister.
+type OpenAddressingRegister struct {
+	Slots       []OpenAddressingSlot
+	Count       int
+	SymbolEqual SymbolEqualFunc
+	Type        RegisterType
+}
+
+func NewOpenAddressingRegister() *OpenAddressingRegister {
+	return &OpenAddressingRegister{
+		Slots:       make([]OpenAddressingSlot, openAddressingInitialSize),
+		Count:       0,
+		SymbolEqual: nil,
+		Type:        OPENADDRESSING,
+	}
+}
+
+func (r *OpenAddressingRegister) GetEquivalenceClass(queryState State) (
+	State, error) {
+	if queryState == nil {
+		return nil, ErrRegisterNilState
+	}
+	hash, err := openAddressingHash(queryState)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := r.home(hash); ; i = (i + 1) & r.mask() {
+		slot := r.Slots[i]
+		if slot.State == nil {
+			break
+		} else if slot.Hash != hash {
+			continue
+		} else if equal, err := registerEquals(queryState, slot.State,
+			r.SymbolEqual); err != nil {
+			return nil, err
+		} else if equal {
+			return slot.State, nil
+		}
+	}
+
+	if (r.Count+1)*4 > len(r.Slots)*3 {
+		r.grow()
+	}
+	r.insert(hash, queryState)
+	return queryState, nil
+}
+
+func (r *OpenAddressingRegister) ContainsState(queryState State) (bool,
+	error) {
+	if queryState == nil {
+		return false, ErrRegisterNilState
+	}
+	if _, found, err := r.find(queryState); err != nil {
+		return false, err
+	} else {
+		return found, nil
+	}
+}
+
+func (r *OpenAddressingRegister) RemoveClass(targetState State) error {
+	if targetState == nil {
+		return ErrRegisterNilState
+	}
+	i, found, err := r.find(targetState)
+	if err != nil {
+		return err
+	} else if !found {
+		return ErrStateDoesNotExist
+	}
+
+	r.Slots[i] = OpenAddressingSlot{}
+	r.Count -= 1
+	for j := (i + 1) & r.mask(); r.Slots[j].State != nil; j = (j + 1) &
+		r.mask() {
+		k := r.home(r.Slots[j].Hash)
+		if (i <= j && (k <= i || k > j)) || (i > j && k <= i && k > j) {
+			r.Slots[i] = r.Slots[j]
+			r.Slots[j] = OpenAddressingSlot{}
+			i = j
+		}
+	}
+	return nil
+}
+
+func (r *OpenAddressingRegister) Reset() error {
+	r.Slots = make([]OpenAddressingSlot, openAddressingInitialSize)
+	r.Count = 0
+	return nil
+}
+
+// Rebuilds the table by re-querying the IsomorphismHash of every stored state,
+// for use after the states' hash function has been swapped. The partition into
+// classes is kept as is. If newHashApplied is false the states still hash as
+// before and there is nothing to do. This is O(states).
+func (r *OpenAddressingRegister) Rehash(newHashApplied bool) error {
+	if !newHashApplied {
+		return nil
+	}
+	hashes := make([]uint64, 0, r.Count)
+	states := make([]State, 0, r.Count)
+	for _, slot := range r.Slots {
+		if slot.State == nil {
+			continue
+		}
+		if hash, err := openAddressingHash(slot.State); err != nil {
+			return err
+		} else {
+			hashes = append(hashes, hash)
+			states = append(states, slot.State)
+		}
+	}
+	r.Slots = make([]OpenAddressingSlot, len(r.Slots))
+	r.Count = 0
+	for i, state := range states {
+		r.insert(hashes[i], state)
+	}
+	return nil
+}
+
+// Slots are grouped by hash, which is passed as a uint64 whatever the width of
+// the states' IsomorphismHash.
+func (r *OpenAddressingRegister) Range(
+	visit func(hash interface{}, states []State) bool) {
+	buckets := make(map[uint64][]State)
+	for _, slot := range r.Slots {
+		if slot.State != nil {
+			buckets[slot.Hash] = append(buckets[slot.Hash], slot.State)
+		}
+	}
+	for hash, states := range buckets {
+		if !visit(hash, states) {
+			return
+		}
+	}
+}
+
+func (r *OpenAddressingRegister) Initialize(startState State) error {
+	return initializeRegister(r, startState)
+}
+
+func (r *OpenAddressingRegister) GetRegisterType() RegisterType {
+	return r.Type
+}
+
+// Returns the slot holding the given state, matched by Id within its probe
+// run.
+func (r *OpenAddressingRegister) find(queryState State) (uint64, bool,
+	error) {
+	hash, err := openAddressingHash(queryState)
+	if err != nil {
+		return 0, false, err
+	}
+	for i := r.home(hash); r.Slots[i].State != nil; i = (i + 1) & r.mask() {
+		slot := r.Slots[i]
+		if slot.Hash == hash && slot.State.GetId() == queryState.GetId() {
+			return i, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (r *OpenAddressingRegister) insert(hash uint64, state State) {
+	i := r.home(hash)
+	for r.Slots[i].State != nil {
+		i = (i + 1) & r.mask()
+	}
+	r.Slots[i] = OpenAddressingSlot{Hash: hash, State: state}
+	r.Count += 1
+}
+
+func (r *OpenAddressingRegister) grow() {
+	oldSlots := r.Slots
+	r.Slots = make([]OpenAddressingSlot, len(oldSlots)*2)
+	r.Count = 0
+	for _, slot := range oldSlots {
+		if slot.State != nil {
+			r.insert(slot.Hash, slot.State)
+		}
+	}
+}
+
+func (r *OpenAddressingRegister) mask() uint64 {
+	return uint64(len(r.Slots) - 1)
+}
+
+// Spreads the hash over the table with Fibonacci hashing, so that hashes
+// differing only in their high bits do not share a probe run.
+func (r *OpenAddressingRegister) home(hash uint64) uint64 {
+	return ((hash * fibonacciHashMultiplier) >> 32) & r.mask()
+}
+
+func openAddressingHash(state State) (uint64, error) {
+	hash, err := registerHash(state)
+	if err != nil {
+		return 0, err
+	}
+	switch h := hash.(type) {
+	case uint32:
+		return uint64(h), nil
+	case uint64:
+		return h, nil
+	default:
+		return 0, &RegisterHashError{Id: state.GetId(),
+			Err: ErrUnsupportedHash}
+	}
+}
@@ -2,12 +2,15 @@ package wilddawg
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 )
 
 type RegisterType int
 
 const (
 	COLLISIONSAFEHASHMAP RegisterType = iota
+	OPENADDRESSING
 )
 
 var (
@@ -17,30 +20,63 @@ var (
 	ErrStateDoesNotExist = errors.New("State does not exist")
 )
 
+// A RegisterHashError reports a state whose IsomorphismHash failed inside a
+// register, e.g. because it was created without an encoding.
+type RegisterHashError struct {
+	Id  StateId
+	Err error
+}
+
+func (e *RegisterHashError) Error() string {
+	return fmt.Sprintf("state %d: %v", e.Id, e.Err)
+}
+
+func (e *RegisterHashError) Unwrap() error {
+	return e.Err
+}
+
 /*
 	The register keeps track of the equivalence classes of the machine. It
 	should be able to initialize itself based on some start state of a minimized
-	DAWG.
+	DAWG. "Range()" calls a function with every non-empty hash bucket, in no
+	particular order, until it returns false.
 */
 type Register interface {
 	GetEquivalenceClass(State) (State, error)
 	RemoveClass(State) error
 	Initialize(State) error
 	Reset() error
+	Rehash(bool) error
+	Range(func(interface{}, []State) bool)
 	GetRegisterType() RegisterType
 }
 
+/*
+	A ContainingRegister can also report whether a state is the stored
+	representative of its equivalence class, without adding it. Validate
+	checks registers for missing states through it.
+*/
+type ContainingRegister interface {
+	Register
+	ContainsState(State) (bool, error)
+}
+
 // This implementation of Register stores equivalence classes using maps of
 // IsomorphismHashes to lists of State pointers. It allows for the possibility
-// of hash collisions.
+// of hash collisions. When SymbolEqual is set, states implementing
+// SymbolEqualState are compared with it instead of == on transitions. Only
+// states in the same hash bucket are compared, so the states' encoding must
+// already give equal symbols equal hashes.
 type CollisionSafeHashMapRegister struct {
 	EquivalenceClassMap map[interface{}][]State
+	SymbolEqual         SymbolEqualFunc
 	Type                RegisterType
 }
 
 func NewCollisionSafeHashMapRegister() *CollisionSafeHashMapRegister {
 	return &CollisionSafeHashMapRegister{
 		EquivalenceClassMap: make(map[interface{}][]State),
+		SymbolEqual:         nil,
 		Type:                COLLISIONSAFEHASHMAP,
 	}
 }
@@ -50,15 +86,17 @@ func (r *CollisionSafeHashMapRegister) GetEquivalenceClass(queryState State) (
 	if queryState == nil {
 		return nil, ErrRegisterNilState
 	}
-	if hash, err := queryState.IsomorphismHash(); err != nil {
+	if hash, err := registerHash(queryState); err != nil {
 		return nil, err
 	} else if stateRef, present := r.EquivalenceClassMap[hash]; !present {
 		r.EquivalenceClassMap[hash] = []State{queryState}
 		return queryState, nil
 	} else {
-		queryMachineEdges := queryState.MachineEdges()
 		for _, state := range stateRef {
-			if sameMachineEdges(queryMachineEdges, state.MachineEdges()) {
+			if equal, err := registerEquals(queryState, state,
+				r.SymbolEqual); err != nil {
+				return nil, err
+			} else if equal {
 				return state, nil
 			}
 		}
@@ -68,11 +106,28 @@ func (r *CollisionSafeHashMapRegister) GetEquivalenceClass(queryState State) (
 	}
 }
 
+func (r *CollisionSafeHashMapRegister) ContainsState(queryState State) (bool,
+	error) {
+	if queryState == nil {
+		return false, ErrRegisterNilState
+	}
+	if hash, err := registerHash(queryState); err != nil {
+		return false, err
+	} else {
+		for _, state := range r.EquivalenceClassMap[hash] {
+			if state.GetId() == queryState.GetId() {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
 func (r *CollisionSafeHashMapRegister) RemoveClass(targetState State) error {
 	if targetState == nil {
 		return ErrRegisterNilState
 	}
-	if hash, err := targetState.IsomorphismHash(); err != nil {
+	if hash, err := registerHash(targetState); err != nil {
 		return err
 	} else if stateRef, present := r.EquivalenceClassMap[hash]; !present {
 		return ErrStateDoesNotExist
@@ -93,7 +148,117 @@ func (r *CollisionSafeHashMapRegister) Reset() error {
 	return nil
 }
 
+// Rebuilds the equivalence class map by re-querying the IsomorphismHash of
+// every stored state, for use after the states' hash function has been
+// swapped. The partition into classes is kept as is. If newHashApplied is
+// false the states still hash as before and there is nothing to do. This is
+// O(states).
+func (r *CollisionSafeHashMapRegister) Rehash(newHashApplied bool) error {
+	if !newHashApplied {
+		return nil
+	}
+	rehashedMap := make(map[interface{}][]State)
+	for _, stateRef := range r.EquivalenceClassMap {
+		for _, state := range stateRef {
+			if hash, err := registerHash(state); err != nil {
+				return err
+			} else {
+				rehashedMap[hash] = append(rehashedMap[hash], state)
+			}
+		}
+	}
+	r.EquivalenceClassMap = rehashedMap
+	return nil
+}
+
+// Each bucket is passed as a copy, so the register cannot be changed through
+// it.
+func (r *CollisionSafeHashMapRegister) Range(
+	visit func(hash interface{}, states []State) bool) {
+	for hash, stateRef := range r.EquivalenceClassMap {
+		if len(stateRef) == 0 {
+			continue
+		}
+		states := make([]State, len(stateRef))
+		copy(states, stateRef)
+		if !visit(hash, states) {
+			return
+		}
+	}
+}
+
 func (r *CollisionSafeHashMapRegister) Initialize(startState State) error {
+	return initializeRegister(r, startState)
+}
+
+// Returns, for each hash bucket, the Ids of the representative states stored
+// in it. Every Id is a distinct equivalence class. Ids are sorted within a
+// bucket and buckets are sorted by their first Id.
+func (r *CollisionSafeHashMapRegister) EquivalenceClasses() [][]StateId {
+	classes := make([][]StateId, 0, len(r.EquivalenceClassMap))
+	for _, stateRef := range r.EquivalenceClassMap {
+		if len(stateRef) == 0 {
+			continue
+		}
+		bucket := make([]StateId, 0, len(stateRef))
+		for _, state := range stateRef {
+			bucket = append(bucket, state.GetId())
+		}
+		sort.Slice(bucket, func(i, j int) bool {
+			return bucket[i] < bucket[j]
+		})
+		classes = append(classes, bucket)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		return classes[i][0] < classes[j][0]
+	})
+	return classes
+}
+
+// Returns a measure of how evenly the stored states' hashes spread over a
+// table with one bin per state, for comparing hash functions on a dataset. The
+// statistic is the sum over bins of b(b+1)/2 for a bin holding b states,
+// divided by its expected value under uniform hashing, so values near 1.0
+// indicate a uniform hash and larger values a skewed one. Hashes must be
+// unsigned integers, otherwise ErrUnsupportedHash is returned. An empty
+// register returns 0.
+func (r *CollisionSafeHashMapRegister) HashUniformity() (float64, error) {
+	stateCount := 0
+	for _, stateRef := range r.EquivalenceClassMap {
+		stateCount += len(stateRef)
+	}
+	if stateCount == 0 {
+		return 0, nil
+	}
+
+	binCount := uint64(stateCount)
+	bins := make([]int, binCount)
+	for hash, stateRef := range r.EquivalenceClassMap {
+		switch h := hash.(type) {
+		case uint32:
+			bins[uint64(h)%binCount] += len(stateRef)
+		case uint64:
+			bins[h%binCount] += len(stateRef)
+		default:
+			return 0, ErrUnsupportedHash
+		}
+	}
+
+	sum := 0.0
+	for _, b := range bins {
+		sum += float64(b) * float64(b+1) / 2
+	}
+	n, m := float64(stateCount), float64(binCount)
+	return sum / ((n / (2 * m)) * (n + 2*m - 1)), nil
+}
+
+func (r *CollisionSafeHashMapRegister) GetRegisterType() RegisterType {
+	return r.Type
+}
+
+// Resets the register and fills it with every state reachable from the start
+// state, failing with ErrNonMinimalMachine if two of them are equivalent.
+func initializeRegister(r Register, startState State) error {
 	if err := r.Reset(); err != nil {
 		return err
 	}
@@ -125,6 +290,23 @@ func (r *CollisionSafeHashMapRegister) Initialize(startState State) error {
 	return nil
 }
 
-func (r *CollisionSafeHashMapRegister) GetRegisterType() RegisterType {
-	return r.Type
+// Compares a queried state to a stored one, using the register's symbol
+// equality when one is set and the queried state supports it.
+func registerEquals(queryState State, storedState State,
+	symbolEqual SymbolEqualFunc) (bool, error) {
+	if symbolState, ok := queryState.(SymbolEqualState); ok &&
+		symbolEqual != nil {
+		return symbolState.EqualsWith(storedState, symbolEqual)
+	}
+	return queryState.Equals(storedState)
+}
+
+// Returns the IsomorphismHash of a state, wrapping any error in a
+// RegisterHashError naming the state.
+func registerHash(state State) (interface{}, error) {
+	hash, err := state.IsomorphismHash()
+	if err != nil {
+		return nil, &RegisterHashError{Id: state.GetId(), Err: err}
+	}
+	return hash, nil
 }
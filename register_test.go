@@ -0,0 +1,515 @@
+package wilddawg
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+// A degenerate hash function that maps every input to the same value, used to
+// force register collisions.
+type constantHash32 struct{}
+
+func (h constantHash32) Write(p []byte) (int, error) { return len(p), nil }
+func (h constantHash32) Reset()                      {}
+func (h constantHash32) Size() int                   { return 4 }
+func (h constantHash32) BlockSize() int              { return 1 }
+func (h constantHash32) Sum32() uint32               { return 7 }
+
+func (h constantHash32) Sum(b []byte) []byte {
+	return append(b, 0, 0, 0, 7)
+}
+
+// Returns the same pseudo-random lowercase words on every call.
+func newRandomTestWords(wordCount int) []string {
+	rng := rand.New(rand.NewSource(1))
+	words := make([]string, 0, wordCount)
+	for i := 0; i < wordCount; i++ {
+		word := make([]byte, 3+rng.Intn(6))
+		for j := range word {
+			word[j] = byte('a' + rng.Intn(6))
+		}
+		words = append(words, string(word))
+	}
+	return words
+}
+
+// Returns a trie over pseudo-random lowercase words, large enough to exercise
+// register growth.
+func newRandomTestTrie(t testing.TB, wordCount int) State {
+	return newTestTrie(t, newTestStateFactory(t), newRandomTestWords(wordCount))
+}
+
+func TestCollisionSafeHashMapRegisterEquivalenceClasses(t *testing.T) {
+	states := newCatBatMachine(t)
+	register := NewCollisionSafeHashMapRegister()
+
+	if classes := register.EquivalenceClasses(); len(classes) != 0 {
+		t.Errorf("Expected no classes in empty register, got %v", classes)
+	}
+	if err := register.Initialize(states[0]); err != nil {
+		t.Fatalf("Error while initializing register: %q", err)
+	}
+
+	classCount := 0
+	seenIds := make(map[StateId]bool)
+	for _, bucket := range register.EquivalenceClasses() {
+		for _, id := range bucket {
+			if seenIds[id] {
+				t.Errorf("State %d reported in more than one class", id)
+			}
+			seenIds[id] = true
+			classCount += 1
+		}
+	}
+	if numStates := len(InDegreeMap(states[0])); classCount != numStates {
+		t.Errorf("Class count %d, want %d", classCount, numStates)
+	}
+}
+
+func TestOpenAddressingRegisterMatchesReference(t *testing.T) {
+	startState := newRandomTestTrie(t, 500)
+	reference := NewCollisionSafeHashMapRegister()
+	register := NewOpenAddressingRegister()
+
+	if register.GetRegisterType() != OPENADDRESSING {
+		t.Errorf("Expected RegisterType %d, got %d", OPENADDRESSING,
+			register.GetRegisterType())
+	}
+
+	for _, state := range OrderedStates(startState) {
+		if expected, err := reference.GetEquivalenceClass(state); err != nil {
+			t.Fatalf("Error while getting equivalence class: %q", err)
+		} else if ref, err := register.GetEquivalenceClass(state); err != nil {
+			t.Fatalf("Error while getting equivalence class: %q", err)
+		} else if ref != expected {
+			t.Errorf("State %d class %d, want %d", state.GetId(),
+				ref.GetId(), expected.GetId())
+		}
+	}
+
+	for _, state := range OrderedStates(startState) {
+		if expected, err := reference.ContainsState(state); err != nil {
+			t.Fatalf("Error while checking state: %q", err)
+		} else if present, err := register.ContainsState(state); err != nil {
+			t.Fatalf("Error while checking state: %q", err)
+		} else if present != expected {
+			t.Errorf("State %d present %t, want %t", state.GetId(), present,
+				expected)
+		}
+	}
+}
+
+// Builds count states, each with a single edge on its index to a shared sink.
+// Their factory hashes with constantHash32, so the states all collide unless
+// configure, which may be nil, sets it up otherwise.
+func newCollidingTestStates(t testing.TB, count int,
+	configure func(*EncodeHashStateFactory)) []State {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	factory, err := NewEncodeHashStateFactory(codecHandle, constantHash32{},
+		LAZYDFAANNOTATED)
+	if err != nil {
+		t.Fatalf("Error while creating state factory: %q", err)
+	}
+	if configure != nil {
+		configure(factory)
+	}
+	sink := newTestStates(t, factory, 1)[0]
+	states := newTestStates(t, factory, count)
+	for i, state := range states {
+		addTestEdge(t, state, fmt.Sprint(i), sink)
+	}
+	return states
+}
+
+func TestOpenAddressingRegisterCollisions(t *testing.T) {
+	states := newCollidingTestStates(t, 40, nil)
+
+	register := NewOpenAddressingRegister()
+	for _, state := range states {
+		if ref, err := register.GetEquivalenceClass(state); err != nil {
+			t.Fatalf("Error while getting equivalence class: %q", err)
+		} else if ref != state {
+			t.Errorf("State %d merged into %d", state.GetId(), ref.GetId())
+		}
+	}
+
+	duplicate := states[5].Clone()
+	if err := duplicate.SetId(1000); err != nil {
+		t.Fatalf("Error while setting Id: %q", err)
+	}
+	if ref, err := register.GetEquivalenceClass(duplicate); err != nil {
+		t.Errorf("Error while getting equivalence class: %q", err)
+	} else if ref != states[5] {
+		t.Errorf("Duplicate merged into %d, want %d", ref.GetId(),
+			states[5].GetId())
+	}
+
+	for i := 0; i < len(states); i += 3 {
+		if err := register.RemoveClass(states[i]); err != nil {
+			t.Errorf("Error while removing class: %q", err)
+		}
+	}
+	if err := register.RemoveClass(states[0]); err != ErrStateDoesNotExist {
+		t.Errorf("Expected %q, got %q", ErrStateDoesNotExist, err)
+	}
+	for i, state := range states {
+		if present, err := register.ContainsState(state); err != nil {
+			t.Errorf("Error while checking state: %q", err)
+		} else if present != (i%3 != 0) {
+			t.Errorf("State %d present %t, want %t", state.GetId(), present,
+				i%3 != 0)
+		}
+	}
+}
+
+func TestOpenAddressingRegisterInitialize(t *testing.T) {
+	register := NewOpenAddressingRegister()
+	if err := register.Initialize(newCatBatMachine(t)[0]); err != nil {
+		t.Errorf("Error while initializing register: %q", err)
+	}
+	if err := register.Initialize(newCatBatTrie(t)[0]); err !=
+		ErrNonMinimalMachine {
+		t.Errorf("Expected %q, got %q", ErrNonMinimalMachine, err)
+	}
+	if err := register.Initialize(nil); err != ErrRegisterNilState {
+		t.Errorf("Expected %q, got %q", ErrRegisterNilState, err)
+	}
+}
+
+func benchmarkRegister(b *testing.B, register Register) {
+	states := OrderedStates(newRandomTestTrie(b, 5000))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := register.Reset(); err != nil {
+			b.Fatalf("Error while resetting register: %q", err)
+		}
+		for _, state := range states {
+			if _, err := register.GetEquivalenceClass(state); err != nil {
+				b.Fatalf("Error while getting equivalence class: %q", err)
+			}
+		}
+	}
+}
+
+func BenchmarkCollisionSafeHashMapRegister(b *testing.B) {
+	benchmarkRegister(b, NewCollisionSafeHashMapRegister())
+}
+
+func BenchmarkOpenAddressingRegister(b *testing.B) {
+	benchmarkRegister(b, NewOpenAddressingRegister())
+}
+
+func TestRegisterRehash(t *testing.T) {
+	for _, register := range []ContainingRegister{
+		NewCollisionSafeHashMapRegister(), NewOpenAddressingRegister()} {
+		states := OrderedStates(newRandomTestTrie(t, 200))
+		representatives := make(map[StateId]StateId)
+		for _, state := range states {
+			if ref, err := register.GetEquivalenceClass(state); err != nil {
+				t.Fatalf("Error while getting equivalence class: %q", err)
+			} else {
+				representatives[state.GetId()] = ref.GetId()
+			}
+		}
+
+		newHashFunc := crc32.NewIEEE()
+		for _, state := range states {
+			state.(*LazyDfaAnnotatedState).HashFunc = newHashFunc
+		}
+		if err := register.Rehash(false); err != nil {
+			t.Errorf("Error while skipping rehash: %q", err)
+		}
+		if present, err := register.ContainsState(states[0]); err != nil {
+			t.Errorf("Error while checking state: %q", err)
+		} else if present {
+			t.Errorf("Register type %d: expected stale register before "+
+				"rehash", register.GetRegisterType())
+		}
+		if err := register.Rehash(true); err != nil {
+			t.Fatalf("Error while rehashing register: %q", err)
+		}
+
+		for _, state := range states {
+			id := state.GetId()
+			isRepresentative := representatives[id] == id
+			if present, err := register.ContainsState(state); err != nil {
+				t.Errorf("Error while checking state: %q", err)
+			} else if present != isRepresentative {
+				t.Errorf("Register type %d: state %d present %t, want %t",
+					register.GetRegisterType(), id, present, isRepresentative)
+			}
+			if ref, err := register.GetEquivalenceClass(state); err != nil {
+				t.Errorf("Error while getting equivalence class: %q", err)
+			} else if ref.GetId() != representatives[id] {
+				t.Errorf("Register type %d: state %d class %d, want %d",
+					register.GetRegisterType(), id, ref.GetId(),
+					representatives[id])
+			}
+		}
+	}
+}
+
+// A transition symbol that is case-insensitive. It encodes in lower case so
+// that equal symbols hash alike under a canonical encoding.
+type caseFoldSymbol string
+
+func (s caseFoldSymbol) CodecEncodeSelf(e *codec.Encoder) {
+	e.MustEncode(strings.ToLower(string(s)))
+}
+
+func (s *caseFoldSymbol) CodecDecodeSelf(d *codec.Decoder) {
+	var decoded string
+	d.MustDecode(&decoded)
+	*s = caseFoldSymbol(decoded)
+}
+
+func caseFoldEqual(a interface{}, b interface{}) bool {
+	aSymbol, aOk := a.(caseFoldSymbol)
+	bSymbol, bOk := b.(caseFoldSymbol)
+	if !aOk || !bOk {
+		return a == b
+	}
+	return strings.EqualFold(string(aSymbol), string(bSymbol))
+}
+
+func TestRegisterSymbolEqual(t *testing.T) {
+	for _, register := range []Register{NewCollisionSafeHashMapRegister(),
+		NewOpenAddressingRegister()} {
+		states := newTestStates(t, newTestStateFactory(t), 3)
+		addTestEdge(t, states[0], caseFoldSymbol("A"), states[2])
+		addTestEdge(t, states[1], caseFoldSymbol("a"), states[2])
+		if hashA, err := states[0].IsomorphismHash(); err != nil {
+			t.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+		} else if hashB, err := states[1].IsomorphismHash(); err != nil {
+			t.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+		} else if hashA != hashB {
+			t.Fatalf("Expected equal symbols to hash alike: %d, %d", hashA,
+				hashB)
+		}
+
+		if _, err := register.GetEquivalenceClass(states[0]); err != nil {
+			t.Errorf("Error while getting equivalence class: %q", err)
+		}
+		if ref, err := register.GetEquivalenceClass(states[1]); err != nil {
+			t.Errorf("Error while getting equivalence class: %q", err)
+		} else if ref != states[1] {
+			t.Errorf("Expected distinct symbols not to merge under ==")
+		}
+
+		if err := register.Reset(); err != nil {
+			t.Errorf("Error while resetting register: %q", err)
+		}
+		switch r := register.(type) {
+		case *CollisionSafeHashMapRegister:
+			r.SymbolEqual = caseFoldEqual
+		case *OpenAddressingRegister:
+			r.SymbolEqual = caseFoldEqual
+		}
+		if _, err := register.GetEquivalenceClass(states[0]); err != nil {
+			t.Errorf("Error while getting equivalence class: %q", err)
+		}
+		if ref, err := register.GetEquivalenceClass(states[1]); err != nil {
+			t.Errorf("Error while getting equivalence class: %q", err)
+		} else if ref != states[0] {
+			t.Errorf("Expected %v, got %v", states[0], ref)
+		}
+	}
+}
+
+func TestCollisionSafeHashMapRegisterHashUniformity(t *testing.T) {
+	register := NewCollisionSafeHashMapRegister()
+	if uniformity, err := register.HashUniformity(); err != nil {
+		t.Errorf("Error while computing hash uniformity: %q", err)
+	} else if uniformity != 0 {
+		t.Errorf("Expected 0 for empty register, got %f", uniformity)
+	}
+
+	for _, state := range OrderedStates(newRandomTestTrie(t, 500)) {
+		if _, err := register.GetEquivalenceClass(state); err != nil {
+			t.Fatalf("Error while getting equivalence class: %q", err)
+		}
+	}
+	if uniformity, err := register.HashUniformity(); err != nil {
+		t.Errorf("Error while computing hash uniformity: %q", err)
+	} else if uniformity < 0.8 || uniformity > 1.2 {
+		t.Errorf("Expected uniformity near 1.0 for fnv32, got %f",
+			uniformity)
+	}
+
+	skewed := NewCollisionSafeHashMapRegister()
+	for _, state := range newCollidingTestStates(t, 40, nil) {
+		if _, err := skewed.GetEquivalenceClass(state); err != nil {
+			t.Fatalf("Error while getting equivalence class: %q", err)
+		}
+	}
+	if uniformity, err := skewed.HashUniformity(); err != nil {
+		t.Errorf("Error while computing hash uniformity: %q", err)
+	} else if uniformity < 10 {
+		t.Errorf("Expected high uniformity statistic for constant hash, "+
+			"got %f", uniformity)
+	}
+}
+
+func TestRegisterRange(t *testing.T) {
+	startState := newRandomTestTrie(t, 200)
+	for _, register := range []Register{NewCollisionSafeHashMapRegister(),
+		NewOpenAddressingRegister()} {
+		stateCount := 0
+		for _, state := range OrderedStates(startState) {
+			if ref, err := register.GetEquivalenceClass(state); err != nil {
+				t.Fatalf("Error while getting equivalence class: %q", err)
+			} else if ref == state {
+				stateCount += 1
+			}
+		}
+
+		visitedHashes := make(map[interface{}]bool)
+		visitedIds := make(map[StateId]bool)
+		bucketCount := 0
+		register.Range(func(hash interface{}, states []State) bool {
+			if visitedHashes[hash] {
+				t.Errorf("Bucket %v visited twice", hash)
+			}
+			visitedHashes[hash] = true
+			bucketCount += 1
+			for _, state := range states {
+				visitedIds[state.GetId()] = true
+			}
+			return true
+		})
+		if len(visitedIds) != stateCount {
+			t.Errorf("Visited %d states, want %d", len(visitedIds),
+				stateCount)
+		}
+
+		visits := 0
+		register.Range(func(hash interface{}, states []State) bool {
+			visits += 1
+			return visits < 3
+		})
+		if bucketCount < 3 {
+			t.Fatalf("Expected at least 3 buckets, got %d", bucketCount)
+		} else if visits != 3 {
+			t.Errorf("Expected Range to stop after 3 buckets, got %d", visits)
+		}
+	}
+}
+
+func TestRegisterHashError(t *testing.T) {
+	for _, register := range []ContainingRegister{
+		NewCollisionSafeHashMapRegister(), NewOpenAddressingRegister()} {
+		nilEncoderState := NewLazyDfaAnnotatedState(42, nil, fnv.New32())
+
+		_, err := register.GetEquivalenceClass(nilEncoderState)
+		var hashErr *RegisterHashError
+		if !errors.As(err, &hashErr) {
+			t.Errorf("Expected *RegisterHashError, got %q", err)
+		} else if hashErr.Id != 42 {
+			t.Errorf("Error state Id %d, want 42", hashErr.Id)
+		}
+		if !errors.Is(err, ErrNilEncoder) {
+			t.Errorf("Expected %q, got %q", ErrNilEncoder, err)
+		}
+
+		if _, err := register.ContainsState(nilEncoderState); !errors.Is(err,
+			ErrNilEncoder) {
+			t.Errorf("Expected %q, got %q", ErrNilEncoder, err)
+		}
+		if err := register.RemoveClass(nilEncoderState); !errors.Is(err,
+			ErrNilEncoder) {
+			t.Errorf("Expected %q, got %q", ErrNilEncoder, err)
+		}
+	}
+
+	problems := Validate(NewLazyDfaAnnotatedState(42, nil, nil),
+		NewCollisionSafeHashMapRegister())
+	if len(problems) != 1 {
+		t.Errorf("Expected 1 problem, got %v", problems)
+	} else if problems[0].Error() != "state 42: "+ErrNilEncoder.Error() {
+		t.Errorf("Expected single state prefix, got %q", problems[0])
+	}
+}
+
+func TestRegisterSecondHashFunc(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		largestBucket := make([]int, 2)
+		for i, hashFunc2 := range []hash.Hash32{nil, crc32.NewIEEE()} {
+			states := newCollidingTestStates(t, 40,
+				func(factory *EncodeHashStateFactory) {
+					factory.HashFunc2 = hashFunc2
+					factory.IncrementalHash = incremental
+				})
+
+			register := NewCollisionSafeHashMapRegister()
+			for _, state := range states {
+				if ref, err := register.GetEquivalenceClass(state); err != nil {
+					t.Fatalf("Error while getting equivalence class: %q", err)
+				} else if ref != state {
+					t.Errorf("State %d merged into %d", state.GetId(),
+						ref.GetId())
+				}
+			}
+			register.Range(func(hash interface{}, states []State) bool {
+				if _, combined := hash.(uint64); combined != (hashFunc2 !=
+					nil) {
+					t.Errorf("Unexpected hash type %T", hash)
+				}
+				if len(states) > largestBucket[i] {
+					largestBucket[i] = len(states)
+				}
+				return true
+			})
+		}
+		if largestBucket[0] != 40 {
+			t.Errorf("Expected 40 colliding states, got %d", largestBucket[0])
+		}
+		if largestBucket[1] != 1 {
+			t.Errorf("Expected no collisions with a second hash, got %d "+
+				"states in one bucket", largestBucket[1])
+		}
+	}
+}
+
+func TestRegisterKVAnnotatedStateCollision(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	sink := NewLazyDfaAnnotatedState(1, codecHandle, constantHash32{})
+	plainState := NewLazyDfaAnnotatedState(2, codecHandle, constantHash32{})
+	kvState := NewLazyDfaKVAnnotatedState(3, codecHandle, constantHash32{})
+	addTestEdge(t, plainState, "a", sink)
+	addTestEdge(t, kvState, "a", sink)
+	if err := kvState.AddAnnotationKV("freq", 10); err != nil {
+		t.Fatalf("Error while adding annotation: %q", err)
+	}
+
+	for _, pair := range [][]State{{plainState, kvState},
+		{kvState, plainState}} {
+		if equal, err := pair[0].Equals(pair[1]); err != nil {
+			t.Errorf("Error while comparing states: %q", err)
+		} else if equal {
+			t.Errorf("State %d equals %d", pair[0].GetId(), pair[1].GetId())
+		}
+		for _, register := range []Register{NewCollisionSafeHashMapRegister(),
+			NewOpenAddressingRegister()} {
+			for _, state := range pair {
+				if ref, err := register.GetEquivalenceClass(
+					state); err != nil {
+					t.Errorf("Error while getting equivalence class: %q", err)
+				} else if ref != state {
+					t.Errorf("State %d merged into %d", state.GetId(),
+						ref.GetId())
+				}
+			}
+		}
+	}
+}
@@ -2,7 +2,10 @@ package wilddawg
 
 import (
 	"errors"
+	"fmt"
 	"hash"
+	"sort"
+	"strings"
 
 	"github.com/ugorji/go/codec"
 )
@@ -11,6 +14,10 @@ type StateType int
 
 const (
 	LAZYDFAANNOTATED StateType = iota
+	SORTEDSLICEDFAANNOTATED
+	LAZYDFAKVANNOTATED
+	HYBRIDDFAANNOTATED
+	LAZYDFAEDGEDATA
 )
 
 var (
@@ -29,8 +36,11 @@ var (
 	identifies its outgoing edges and destination states without
 	reliance on memory addresses. "MachineEdges()" returns an edge
 	map that is based on Id values rather than memory addresses.
+	"Equals()" reports whether two states belong to the same
+	equivalence class, and must agree with "IsomorphismHash()".
 	The "Clone()" function returns a new State with the same
-	outgoing edges and destinations.
+	outgoing edges and destinations. "StableEdges()" lists the
+	outgoing edges in an order that is the same across runs.
 */
 type StateId int
 
@@ -44,33 +54,144 @@ type State interface {
 	RemoveEdge(interface{}, State) error
 	FollowEdge(interface{}) []State
 	FollowAllEdges() []State
+	EdgesTo(State) []interface{}
 	MachineEdges() map[interface{}]StateId
+	StableEdges() []EdgePair
 	IsomorphismHash() (interface{}, error)
+	Equals(State) (bool, error)
 	Clone() State
 	GetStateType() StateType
 }
 
+type EdgePair struct {
+	Transition  interface{}
+	Destination State
+}
+
+/*
+	A UserDataState can hold arbitrary per-state values keyed by user-chosen
+	keys. Unlike annotations, user data is mutable in place and never takes
+	part in a state's IsomorphismHash, so it does not block merging.
+*/
+type UserDataState interface {
+	State
+	SetUserData(interface{}, interface{})
+	GetUserData(interface{}) (interface{}, bool)
+}
+
+/*
+	A TransitionKeyFunc derives a stable, encodable key from a transition,
+	which states hash and compare in place of the transition itself.
+*/
+type TransitionKeyFunc func(interface{}) interface{}
+
+/*
+	A SymbolEqualFunc reports whether two transition symbols are equal. It
+	replaces == on interface{} for symbol types whose distinct values should
+	be treated as one symbol, such as normalized representations.
+*/
+type SymbolEqualFunc func(interface{}, interface{}) bool
+
+/*
+	A SymbolEqualState can compare its machine edges to those of another
+	state using a custom SymbolEqualFunc. A nil SymbolEqualFunc means ==, so
+	EqualsWith(other, nil) agrees with Equals(other).
+*/
+type SymbolEqualState interface {
+	State
+	EqualsWith(State, SymbolEqualFunc) (bool, error)
+}
+
 // This implementation lazily provides machine edge information. It is
 // a state for a deterministic finite automaton that also holds annotation
 // information.
+//
+// When IncrementalHash is set, the state keeps a running XOR of per-edge
+// hashes of (transition, destination Id), updated on AddEdge and RemoveEdge,
+// and returns it from IsomorphismHash instead of re-encoding every edge. This
+// is cheaper during incremental construction but collides more often than
+// the canonical encoding, since edges whose hashes cancel out are not told
+// apart; the register still separates such states with Equals. The
+// accumulator goes stale if a destination's Id changes after the edge is
+// added, and all states sharing a register must use the same hashing mode.
+//
+// When SharedEncoder is set, canonical hashes are encoded with it instead of
+// allocating a new encoder and buffer for every call.
+//
+// When SymbolTable is set, AddEdge interns each transition through it before
+// storing the edge.
+//
+// After FreezeAnnotations, annotations live in FrozenAnnotations, a sorted
+// slice, and Annotations is nil.
+//
+// When TransitionKeyFunc is set, IsomorphismHash and Equals see every
+// transition through it, while the edges themselves keep and are followed by
+// the original transitions. This lets transitions that do not encode stably,
+// such as pointers, be hashed by a stable key instead. The function must
+// return equal keys exactly for interchangeable transitions, must not map two
+// transitions of one state to the same key, and must be the same for all
+// states sharing a register.
+//
+// When HashFunc2 is set, the encoding is hashed with both hash functions and
+// IsomorphismHash returns the two 32 bit hashes combined into a uint64, with
+// HashFunc in the high half. States that collide under one hash function
+// rarely collide under both, so the register compares fewer candidates with
+// Equals. In incremental mode a second accumulator, EdgeHashXor2, is kept.
+//
+// When UnsafeNoDupCheck is set, AddEdge does not check whether the transition
+// is already in use and overwrites any edge it has. This saves a map lookup
+// per edge when loading a machine that is known to be well formed, and must
+// not be used otherwise: an overwritten edge is silently lost, along with any
+// edge data on it. An incremental hash stays correct, since the replaced edge
+// is looked up to take it out of the hash.
 type LazyDfaAnnotatedState struct {
-	Id          StateId
-	Edges       map[interface{}]State
-	Encoding    codec.Handle
-	HashFunc    hash.Hash32
-	Annotations map[interface{}]bool
-	Type        StateType
+	Id                StateId
+	Edges             map[interface{}]State
+	Encoding          codec.Handle
+	HashFunc          hash.Hash32
+	HashFunc2         hash.Hash32
+	Annotations       map[interface{}]bool
+	UserData          map[interface{}]interface{}
+	IncrementalHash   bool
+	EdgeHashXor       uint32
+	EdgeHashXor2      uint32
+	SharedEncoder     *ReusableEncoder
+	SymbolTable       *SymbolTable
+	AnnotationsFrozen bool
+	FrozenAnnotations []interface{}
+	TransitionKeyFunc TransitionKeyFunc
+	UnsafeNoDupCheck  bool
+	Type              StateType
 }
 
 func NewLazyDfaAnnotatedState(id StateId, encoding codec.Handle,
 	hashFunc hash.Hash32) *LazyDfaAnnotatedState {
+	return NewLazyDfaAnnotatedStateWithCapacity(id, encoding, hashFunc, 0)
+}
+
+// Returns a new state whose edge map has room for edgeCapacity edges, so that
+// states with a known bounded degree do not grow the map while edges are
+// added. The capacity does not affect behavior.
+func NewLazyDfaAnnotatedStateWithCapacity(id StateId, encoding codec.Handle,
+	hashFunc hash.Hash32, edgeCapacity int) *LazyDfaAnnotatedState {
 	return &LazyDfaAnnotatedState{
-		Id:          id,
-		Edges:       make(map[interface{}]State),
-		Encoding:    encoding,
-		HashFunc:    hashFunc,
-		Type:        LAZYDFAANNOTATED,
-		Annotations: make(map[interface{}]bool),
+		Id:                id,
+		Edges:             make(map[interface{}]State, edgeCapacity),
+		Encoding:          encoding,
+		HashFunc:          hashFunc,
+		HashFunc2:         nil,
+		Type:              LAZYDFAANNOTATED,
+		Annotations:       make(map[interface{}]bool),
+		UserData:          nil,
+		IncrementalHash:   false,
+		EdgeHashXor:       0,
+		EdgeHashXor2:      0,
+		SharedEncoder:     nil,
+		SymbolTable:       nil,
+		AnnotationsFrozen: false,
+		FrozenAnnotations: nil,
+		TransitionKeyFunc: nil,
+		UnsafeNoDupCheck:  false,
 	}
 }
 
@@ -84,11 +205,28 @@ func (s *LazyDfaAnnotatedState) SetId(id StateId) error {
 }
 
 func (s *LazyDfaAnnotatedState) AddAnnotation(annotation interface{}) error {
+	if s.AnnotationsFrozen {
+		if i, present := s.searchFrozenAnnotations(annotation); !present {
+			s.FrozenAnnotations = append(s.FrozenAnnotations, nil)
+			copy(s.FrozenAnnotations[i+1:], s.FrozenAnnotations[i:])
+			s.FrozenAnnotations[i] = annotation
+		}
+		return nil
+	}
 	s.Annotations[annotation] = true
 	return nil
 }
 
 func (s *LazyDfaAnnotatedState) RemoveAnnotation(annotation interface{}) error {
+	if s.AnnotationsFrozen {
+		i, present := s.searchFrozenAnnotations(annotation)
+		if !present {
+			return ErrAnnotationInvalid
+		}
+		s.FrozenAnnotations = append(s.FrozenAnnotations[:i],
+			s.FrozenAnnotations[i+1:]...)
+		return nil
+	}
 	if _, present := s.Annotations[annotation]; !present {
 		return ErrAnnotationInvalid
 	}
@@ -97,6 +235,11 @@ func (s *LazyDfaAnnotatedState) RemoveAnnotation(annotation interface{}) error {
 }
 
 func (s *LazyDfaAnnotatedState) GetAnnotations() ([]interface{}, error) {
+	if s.AnnotationsFrozen {
+		annotationList := make([]interface{}, len(s.FrozenAnnotations))
+		copy(annotationList, s.FrozenAnnotations)
+		return annotationList, nil
+	}
 	annotationList := make([]interface{}, 0, len(s.Annotations))
 	for annotation := range s.Annotations {
 		annotationList = append(annotationList, annotation)
@@ -104,10 +247,97 @@ func (s *LazyDfaAnnotatedState) GetAnnotations() ([]interface{}, error) {
 	return annotationList, nil
 }
 
+// Returns the annotations sorted by printed form and then type name, the order
+// kept by frozen annotations.
+func (s *LazyDfaAnnotatedState) GetAnnotationsSorted() ([]interface{},
+	error) {
+	annotationList, err := s.GetAnnotations()
+	if err != nil {
+		return nil, err
+	}
+	if !s.AnnotationsFrozen {
+		sortAnnotations(annotationList)
+	}
+	return annotationList, nil
+}
+
+// Converts the annotation map into a slice sorted like GetAnnotationsSorted,
+// which takes less memory for read-mostly machines. Annotations can still
+// be added and removed afterwards; both find their position by binary search.
+// Freezing frozen annotations does nothing.
+func (s *LazyDfaAnnotatedState) FreezeAnnotations() {
+	if s.AnnotationsFrozen {
+		return
+	}
+	frozen := make([]interface{}, 0, len(s.Annotations))
+	for annotation := range s.Annotations {
+		frozen = append(frozen, annotation)
+	}
+	sortAnnotations(frozen)
+	s.FrozenAnnotations = frozen
+	s.Annotations = nil
+	s.AnnotationsFrozen = true
+}
+
+// Returns the position of the annotation in the frozen slice, or the position
+// at which it would be inserted if it is not present. Distinct annotations
+// with the same sort key are told apart with ==.
+func (s *LazyDfaAnnotatedState) searchFrozenAnnotations(
+	annotation interface{}) (int, bool) {
+	key := annotationSortKey(annotation)
+	i := sort.Search(len(s.FrozenAnnotations), func(i int) bool {
+		return annotationSortKey(s.FrozenAnnotations[i]) >= key
+	})
+	for j := i; j < len(s.FrozenAnnotations) &&
+		annotationSortKey(s.FrozenAnnotations[j]) == key; j++ {
+		if s.FrozenAnnotations[j] == annotation {
+			return j, true
+		}
+	}
+	return i, false
+}
+
+func (s *LazyDfaAnnotatedState) SetUserData(key interface{},
+	value interface{}) {
+	if s.UserData == nil {
+		s.UserData = make(map[interface{}]interface{})
+	}
+	s.UserData[key] = value
+}
+
+func (s *LazyDfaAnnotatedState) GetUserData(key interface{}) (interface{},
+	bool) {
+	value, present := s.UserData[key]
+	return value, present
+}
+
 func (s *LazyDfaAnnotatedState) AddEdge(edgeTransition interface{},
 	destination State) error {
-	if _, present := s.Edges[edgeTransition]; present {
-		return ErrEdgeAlreadyUsed
+	if !s.UnsafeNoDupCheck {
+		if _, present := s.Edges[edgeTransition]; present {
+			return ErrEdgeAlreadyUsed
+		}
+	}
+	if s.SymbolTable != nil {
+		edgeTransition = s.SymbolTable.Intern(edgeTransition)
+	}
+	if s.IncrementalHash {
+		edgeHash, edgeHash2, err := s.edgeHash(edgeTransition, destination)
+		if err != nil {
+			return err
+		}
+		// An edge can only be replaced with UnsafeNoDupCheck set.
+		if replaced, present := s.Edges[edgeTransition]; present {
+			replacedHash, replacedHash2, err := s.edgeHash(edgeTransition,
+				replaced)
+			if err != nil {
+				return err
+			}
+			edgeHash ^= replacedHash
+			edgeHash2 ^= replacedHash2
+		}
+		s.EdgeHashXor ^= edgeHash
+		s.EdgeHashXor2 ^= edgeHash2
 	}
 	s.Edges[edgeTransition] = destination
 	return nil
@@ -120,10 +350,25 @@ func (s *LazyDfaAnnotatedState) RemoveEdge(edgeTransition interface{},
 	} else if edgeTo != destination {
 		return ErrEdgeNotPresent
 	}
+	if s.IncrementalHash {
+		edgeHash, edgeHash2, err := s.edgeHash(edgeTransition, destination)
+		if err != nil {
+			return err
+		}
+		s.EdgeHashXor ^= edgeHash
+		s.EdgeHashXor2 ^= edgeHash2
+	}
 	delete(s.Edges, edgeTransition)
 	return nil
 }
 
+// Returns the incremental hashes of an edge, as encodeEdgeHash does.
+func (s *LazyDfaAnnotatedState) edgeHash(edgeTransition interface{},
+	destination State) (uint32, uint32, error) {
+	return encodeEdgeHash(transitionKey(edgeTransition, s.TransitionKeyFunc),
+		destination.GetId(), s.Encoding, s.HashFunc, s.HashFunc2)
+}
+
 func (s *LazyDfaAnnotatedState) FollowEdge(edgeTransition interface{}) []State {
 	destinationStates := make([]State, 0)
 	if destination, present := s.Edges[edgeTransition]; present {
@@ -145,6 +390,16 @@ func (s *LazyDfaAnnotatedState) FollowAllEdges() []State {
 	return destinationStates
 }
 
+func (s *LazyDfaAnnotatedState) EdgesTo(destination State) []interface{} {
+	edgeTransitions := make([]interface{}, 0)
+	for edge, edgeTo := range s.Edges {
+		if edgeTo == destination {
+			edgeTransitions = append(edgeTransitions, edge)
+		}
+	}
+	return edgeTransitions
+}
+
 func (s *LazyDfaAnnotatedState) MachineEdges() map[interface{}]StateId {
 	machineEdges := make(map[interface{}]StateId)
 	for edge, dest := range s.Edges {
@@ -153,37 +408,395 @@ func (s *LazyDfaAnnotatedState) MachineEdges() map[interface{}]StateId {
 	return machineEdges
 }
 
-func (s *LazyDfaAnnotatedState) IsomorphismHash() (interface{}, error) {
-	if s.Encoding == nil {
-		return 0, ErrNilEncoder
+// Returns the machine edges keyed by TransitionKeyFunc, as seen by
+// IsomorphismHash and Equals.
+func (s *LazyDfaAnnotatedState) keyedMachineEdges() map[interface{}]StateId {
+	return keyEdges(s.MachineEdges(), s.TransitionKeyFunc)
+}
+
+// Returns the edges sorted by the canonical encoding of their transitions, or
+// by printed form if the state has no encoding.
+func (s *LazyDfaAnnotatedState) StableEdges() []EdgePair {
+	edgePairs := make([]EdgePair, 0, len(s.Edges))
+	for edge, destination := range s.Edges {
+		edgePairs = append(edgePairs, EdgePair{
+			Transition:  edge,
+			Destination: destination,
+		})
 	}
-	if s.HashFunc == nil {
-		return 0, ErrNilHashFunc
+	sortEdgePairs(edgePairs, s.Encoding)
+	return edgePairs
+}
+
+func (s *LazyDfaAnnotatedState) IsomorphismHash() (interface{}, error) {
+	if s.IncrementalHash {
+		return incrementalHash(s.EdgeHashXor, s.EdgeHashXor2, s.HashFunc2),
+			nil
 	}
-	encodedBytes := make([]byte, 0, 64)
-	encoder := codec.NewEncoderBytes(&encodedBytes, s.Encoding)
-	if err := encoder.Encode(s.MachineEdges()); err != nil {
-		return 0, err
+	if s.SharedEncoder != nil {
+		return s.SharedEncoder.hashes(s.keyedMachineEdges(), s.HashFunc,
+			s.HashFunc2)
 	}
-	s.HashFunc.Reset()
-	_, err := s.HashFunc.Write(encodedBytes)
-	if err != nil {
-		return 0, err
+	return encodeHashes(s.keyedMachineEdges(), s.Encoding, s.HashFunc,
+		s.HashFunc2)
+}
+
+// Two states are equal when their machine edges are. Annotations and user data
+// are not compared, matching IsomorphismHash, but a state with key/value
+// annotations or hashed edge data never equals this one, so that equality is
+// symmetric.
+func (s *LazyDfaAnnotatedState) Equals(other State) (bool, error) {
+	return s.EqualsWith(other, nil)
+}
+
+func (s *LazyDfaAnnotatedState) EqualsWith(other State,
+	symbolEqual SymbolEqualFunc) (bool, error) {
+	return s.sameEdgesWith(other, symbolEqual) &&
+		sameKVAnnotations(s, other) &&
+		sameHashedEdgeData(s, other, s.TransitionKeyFunc), nil
+}
+
+// Returns whether the other state is not nil and has the same machine edges,
+// with transitions keyed by the state's TransitionKeyFunc.
+func (s *LazyDfaAnnotatedState) sameEdgesWith(other State,
+	symbolEqual SymbolEqualFunc) bool {
+	if other == nil {
+		return false
 	}
-	return s.HashFunc.Sum32(), nil
+	return sameMachineEdgesWith(s.keyedMachineEdges(),
+		keyEdges(other.MachineEdges(), s.TransitionKeyFunc), symbolEqual)
 }
 
+// Clone is shallow: the clone gets its own edge, annotation and user data maps,
+// but its edges lead to the same destination states as the original's.
 func (s *LazyDfaAnnotatedState) Clone() State {
 	clone := NewLazyDfaAnnotatedState(s.Id, s.Encoding, s.HashFunc)
+	clone.HashFunc2 = s.HashFunc2
 	for edge, destination := range s.Edges {
 		clone.Edges[edge] = destination
 	}
 	for annotation, placeholder := range s.Annotations {
 		clone.Annotations[annotation] = placeholder
 	}
+	if s.AnnotationsFrozen {
+		clone.FrozenAnnotations = make([]interface{},
+			len(s.FrozenAnnotations))
+		copy(clone.FrozenAnnotations, s.FrozenAnnotations)
+		clone.Annotations = nil
+		clone.AnnotationsFrozen = true
+	}
+	for key, value := range s.UserData {
+		clone.SetUserData(key, value)
+	}
+	clone.IncrementalHash = s.IncrementalHash
+	clone.EdgeHashXor = s.EdgeHashXor
+	clone.EdgeHashXor2 = s.EdgeHashXor2
+	clone.SharedEncoder = s.SharedEncoder
+	clone.SymbolTable = s.SymbolTable
+	clone.TransitionKeyFunc = s.TransitionKeyFunc
+	clone.UnsafeNoDupCheck = s.UnsafeNoDupCheck
 	return clone
 }
 
+// Returns a clone of the machine reachable from this state. Unlike Clone,
+// every reachable destination is cloned as well, so the copy shares no state
+// with the original. Ids are kept, and destinations shared within the original
+// stay shared within the copy.
+func (s *LazyDfaAnnotatedState) CloneDeep() State {
+	return cloneDeep(s)
+}
+
 func (s *LazyDfaAnnotatedState) GetStateType() StateType {
 	return s.Type
 }
+
+func (s *LazyDfaAnnotatedState) String() string {
+	return formatState(s)
+}
+
+// Clones every state reachable from the start state, keeping Ids, and rewires
+// the clones' edges to the cloned destinations.
+func cloneDeep(startState State) State {
+	originalStates := OrderedStates(startState)
+	clones := make(map[StateId]State, len(originalStates))
+	for _, state := range originalStates {
+		clones[state.GetId()] = state.Clone()
+	}
+	for _, state := range originalStates {
+		clone := clones[state.GetId()]
+		for edge, destId := range state.MachineEdges() {
+			destination := state.FollowEdge(edge)[0]
+			// Edges were copied from the original, so this cannot fail.
+			redirectEdge(clone, edge, destination, clones[destId])
+		}
+	}
+	return clones[startState.GetId()]
+}
+
+// Returns the key of a transition, or the transition itself if there is no key
+// function.
+func transitionKey(edgeTransition interface{},
+	keyFunc TransitionKeyFunc) interface{} {
+	if keyFunc == nil {
+		return edgeTransition
+	}
+	return keyFunc(edgeTransition)
+}
+
+// Returns machine edges with every transition replaced by its key.
+func keyEdges(machineEdges map[interface{}]StateId,
+	keyFunc TransitionKeyFunc) map[interface{}]StateId {
+	if keyFunc == nil {
+		return machineEdges
+	}
+	keyedEdges := make(map[interface{}]StateId, len(machineEdges))
+	for edge, destId := range machineEdges {
+		keyedEdges[keyFunc(edge)] = destId
+	}
+	return keyedEdges
+}
+
+// Hashes the canonical encoding of a value, usually a machine edge map. States
+// that should be interchangeable in a register must hash their machine edges
+// this way.
+func encodeHash(value interface{}, encoding codec.Handle,
+	hashFunc hash.Hash32) (interface{}, error) {
+	return encodeHashes(value, encoding, hashFunc, nil)
+}
+
+// Like encodeHash, but when hashFunc2 is set the encoding is also hashed with
+// it and the two hashes are returned combined by combineHashes.
+func encodeHashes(value interface{}, encoding codec.Handle, hashFunc,
+	hashFunc2 hash.Hash32) (interface{}, error) {
+	if encoding == nil {
+		return 0, ErrNilEncoder
+	}
+	if hashFunc == nil {
+		return 0, ErrNilHashFunc
+	}
+	encodedBytes := make([]byte, 0, 64)
+	encoder := codec.NewEncoderBytes(&encodedBytes, encoding)
+	if err := encoder.Encode(value); err != nil {
+		return 0, err
+	}
+	return sumHashes(encodedBytes, hashFunc, hashFunc2)
+}
+
+// Hashes the canonical encoding of a single (transition, destination Id) pair
+// for incremental hashing. The second hash is 0 when hashFunc2 is nil.
+func encodeEdgeHash(edgeTransition interface{}, destinationId StateId,
+	encoding codec.Handle, hashFunc, hashFunc2 hash.Hash32) (uint32, uint32,
+	error) {
+	if encoding == nil {
+		return 0, 0, ErrNilEncoder
+	}
+	if hashFunc == nil {
+		return 0, 0, ErrNilHashFunc
+	}
+	encodedBytes := make([]byte, 0, 32)
+	encoder := codec.NewEncoderBytes(&encodedBytes, encoding)
+	edge := []interface{}{edgeTransition, destinationId}
+	if err := encoder.Encode(edge); err != nil {
+		return 0, 0, err
+	}
+	edgeHash, err := sumHash32(encodedBytes, hashFunc)
+	if err != nil || hashFunc2 == nil {
+		return edgeHash, 0, err
+	}
+	edgeHash2, err := sumHash32(encodedBytes, hashFunc2)
+	return edgeHash, edgeHash2, err
+}
+
+// Returns the hash of encoded bytes as a uint32, or as a uint64 combining it
+// with the hash under hashFunc2 when that is set.
+func sumHashes(encodedBytes []byte, hashFunc, hashFunc2 hash.Hash32) (
+	interface{}, error) {
+	firstHash, err := sumHash32(encodedBytes, hashFunc)
+	if err != nil {
+		return 0, err
+	}
+	if hashFunc2 == nil {
+		return firstHash, nil
+	}
+	secondHash, err := sumHash32(encodedBytes, hashFunc2)
+	if err != nil {
+		return 0, err
+	}
+	return combineHashes(firstHash, secondHash), nil
+}
+
+func sumHash32(encodedBytes []byte, hashFunc hash.Hash32) (uint32, error) {
+	hashFunc.Reset()
+	if _, err := hashFunc.Write(encodedBytes); err != nil {
+		return 0, err
+	}
+	return hashFunc.Sum32(), nil
+}
+
+// Combines two independent 32 bit hashes into one 64 bit hash, the first in
+// the high half.
+func combineHashes(firstHash, secondHash uint32) uint64 {
+	return uint64(firstHash)<<32 | uint64(secondHash)
+}
+
+// Returns the incremental hash of a state from its accumulators, combined
+// when the state has a second hash function.
+func incrementalHash(edgeHashXor, edgeHashXor2 uint32,
+	hashFunc2 hash.Hash32) interface{} {
+	if hashFunc2 == nil {
+		return edgeHashXor
+	}
+	return combineHashes(edgeHashXor, edgeHashXor2)
+}
+
+// A ReusableEncoder hashes canonical encodings with a single encoder and
+// buffer that are reset between uses, avoiding two allocations per hash on
+// the minimization path. It holds mutable state, so it must only be used by
+// one goroutine at a time; share it among the states of a single-goroutine
+// build.
+type ReusableEncoder struct {
+	Encoding codec.Handle
+	buffer   []byte
+	encoder  *codec.Encoder
+}
+
+func NewReusableEncoder(encoding codec.Handle) *ReusableEncoder {
+	e := &ReusableEncoder{
+		Encoding: encoding,
+		buffer:   make([]byte, 0, 64),
+	}
+	if encoding != nil {
+		e.encoder = codec.NewEncoderBytes(&e.buffer, encoding)
+	}
+	return e
+}
+
+// Hashes the canonical encoding of a value. The result is identical to the
+// allocating encodeHash for the same encoding and hash function.
+func (e *ReusableEncoder) Hash(value interface{}, hashFunc hash.Hash32) (
+	interface{}, error) {
+	return e.hashes(value, hashFunc, nil)
+}
+
+// Like Hash, but combines the hashes under both functions as encodeHashes
+// does when hashFunc2 is set.
+func (e *ReusableEncoder) hashes(value interface{}, hashFunc,
+	hashFunc2 hash.Hash32) (interface{}, error) {
+	if e.encoder == nil {
+		return 0, ErrNilEncoder
+	}
+	if hashFunc == nil {
+		return 0, ErrNilHashFunc
+	}
+	e.buffer = e.buffer[:0]
+	e.encoder.ResetBytes(&e.buffer)
+	if err := e.encoder.Encode(value); err != nil {
+		return 0, err
+	}
+	return sumHashes(e.buffer, hashFunc, hashFunc2)
+}
+
+// A SymbolTable keeps one canonical value per distinct transition symbol, so
+// that equal symbols added by many states, such as strings decoded from
+// separate input lines, share a single backing value instead of each holding
+// a copy. Interning only affects storage: symbols still compare by value, so
+// states with interned and non-interned edges hash and compare alike. Like the
+// edge maps themselves, a SymbolTable is not safe for concurrent use.
+type SymbolTable struct {
+	Symbols map[interface{}]interface{}
+}
+
+func NewSymbolTable() *SymbolTable {
+	return &SymbolTable{
+		Symbols: make(map[interface{}]interface{}),
+	}
+}
+
+// Returns the canonical value equal to the given symbol, recording the symbol
+// itself if no equal one has been seen.
+func (t *SymbolTable) Intern(symbol interface{}) interface{} {
+	if interned, present := t.Symbols[symbol]; present {
+		return interned
+	}
+	t.Symbols[symbol] = symbol
+	return symbol
+}
+
+// Sorts edges in place by the encoding of their transitions. Without an
+// encoding, or if a transition cannot be encoded, edges are sorted by the
+// printed form of their transitions instead. Transitions that sort alike,
+// e.g. int(1) and int64(1), are ordered by type name and then printed form,
+// so the order never depends on that of the input.
+func sortEdgePairs(edgePairs []EdgePair, encoding codec.Handle) {
+	keys := make(map[interface{}]string, len(edgePairs))
+	for _, edgePair := range edgePairs {
+		keys[edgePair.Transition] = fmt.Sprint(edgePair.Transition)
+	}
+	if encoding != nil {
+		encodedKeys := make(map[interface{}]string, len(edgePairs))
+		for _, edgePair := range edgePairs {
+			encoded := make([]byte, 0, 16)
+			encoder := codec.NewEncoderBytes(&encoded, encoding)
+			if err := encoder.Encode(edgePair.Transition); err != nil {
+				encodedKeys = nil
+				break
+			}
+			encodedKeys[edgePair.Transition] = string(encoded)
+		}
+		if encodedKeys != nil {
+			keys = encodedKeys
+		}
+	}
+	sort.SliceStable(edgePairs, func(i, j int) bool {
+		a, b := edgePairs[i].Transition, edgePairs[j].Transition
+		if keys[a] != keys[b] {
+			return keys[a] < keys[b]
+		}
+		return transitionTieKey(a) < transitionTieKey(b)
+	})
+}
+
+// Returns the key that orders transitions sorting alike by their encoding or
+// printed form: the type name, then the printed form.
+func transitionTieKey(transition interface{}) string {
+	return fmt.Sprintf("%T\x00%v", transition, transition)
+}
+
+// Sorts annotations in place by printed form, then by type name, so that e.g.
+// 1 and "1" always come out in the same order.
+func sortAnnotations(annotations []interface{}) {
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotationSortKey(annotations[i]) <
+			annotationSortKey(annotations[j])
+	})
+}
+
+func annotationSortKey(annotation interface{}) string {
+	return fmt.Sprintf("%v\x00%T", annotation, annotation)
+}
+
+// Formats a state as its Id, its annotations in braces if it has any, and its
+// edges as "symbol->destId", e.g. "3 {end}: a->4 b->4". Annotations are sorted
+// by their printed form and edges are in StableEdges order, so the output is
+// deterministic.
+func formatState(s State) string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "%d", s.GetId())
+
+	if annotations, err := s.GetAnnotations(); err == nil &&
+		len(annotations) != 0 {
+		printed := make([]string, 0, len(annotations))
+		for _, annotation := range annotations {
+			printed = append(printed, fmt.Sprint(annotation))
+		}
+		sort.Strings(printed)
+		fmt.Fprintf(&builder, " {%s}", strings.Join(printed, ","))
+	}
+
+	builder.WriteString(":")
+	for _, edgePair := range s.StableEdges() {
+		fmt.Fprintf(&builder, " %v->%d", edgePair.Transition,
+			edgePair.Destination.GetId())
+	}
+	return builder.String()
+}
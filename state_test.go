@@ -2,6 +2,8 @@ package wilddawg
 
 import (
 	"hash/fnv"
+	"reflect"
+	"runtime"
 	"testing"
 
 	"github.com/ugorji/go/codec"
@@ -157,6 +159,40 @@ func TestLazyDfaAnnotatedStateEdge(t *testing.T) {
 	}
 }
 
+func TestLazyDfaAnnotatedStateEdgesTo(t *testing.T) {
+	var testStateA State = NewLazyDfaAnnotatedState(1, nil, nil)
+	var testStateB State = NewLazyDfaAnnotatedState(2, nil, nil)
+	var testStateC State = NewLazyDfaAnnotatedState(3, nil, nil)
+
+	if edges := testStateA.EdgesTo(testStateB); len(edges) != 0 {
+		t.Errorf("Expected no edges, got %v", edges)
+	}
+
+	if err := testStateA.AddEdge("a", testStateB); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if err := testStateA.AddEdge("b", testStateB); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if err := testStateA.AddEdge("c", testStateC); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+
+	expected := []interface{}{"a", "b"}
+	if edges := testStateA.EdgesTo(testStateB); !slicesSameValues(edges,
+		expected) {
+		t.Errorf("Expected %v, got %v", expected, edges)
+	}
+	expected = []interface{}{"c"}
+	if edges := testStateA.EdgesTo(testStateC); !slicesSameValues(edges,
+		expected) {
+		t.Errorf("Expected %v, got %v", expected, edges)
+	}
+	if edges := testStateA.EdgesTo(testStateA); len(edges) != 0 {
+		t.Errorf("Expected no edges, got %v", edges)
+	}
+}
+
 func TestLazyDfaAnnotatedStateMachineEdges(t *testing.T) {
 	var testStateA State = NewLazyDfaAnnotatedState(1, nil, nil)
 
@@ -282,6 +318,63 @@ func TestLazyDfaAnnotatedStateIsomorphismHash(t *testing.T) {
 	}
 }
 
+func TestLazyDfaAnnotatedStateEquals(t *testing.T) {
+	var testStateA State = NewLazyDfaAnnotatedState(1, nil, nil)
+	var testStateB State = NewLazyDfaAnnotatedState(2, nil, nil)
+	var testStateC State = NewLazyDfaAnnotatedState(3, nil, nil)
+	var testStateD State = NewLazyDfaAnnotatedState(4, nil, nil)
+
+	if equal, err := testStateA.Equals(testStateB); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if !equal {
+		t.Errorf("Expected states without edges to be equal")
+	}
+	if equal, err := testStateA.Equals(nil); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if equal {
+		t.Errorf("Expected state to differ from nil")
+	}
+
+	if err := testStateA.AddEdge("a", testStateC); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if err := testStateB.AddEdge("a", testStateC); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if equal, err := testStateA.Equals(testStateB); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if !equal {
+		t.Errorf("Expected states with identical edges to be equal")
+	}
+
+	if err := testStateA.AddAnnotation("x"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if equal, err := testStateA.Equals(testStateB); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if !equal {
+		t.Errorf("Expected annotations to be ignored by Equals")
+	}
+
+	if err := testStateB.AddEdge("b", testStateC); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if equal, err := testStateA.Equals(testStateB); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if equal {
+		t.Errorf("Expected states with different transitions to differ")
+	}
+
+	if err := testStateA.AddEdge("b", testStateD); err != nil {
+		t.Errorf("Error while adding edge: %q", err)
+	}
+	if equal, err := testStateA.Equals(testStateB); err != nil {
+		t.Errorf("Error while comparing states: %q", err)
+	} else if equal {
+		t.Errorf("Expected states with different destinations to differ")
+	}
+}
+
 func TestLazyDfaAnnotatedStateClone(t *testing.T) {
 	sharedCodecHandle := new(codec.BincHandle)
 	sharedCodecHandle.Canonical = true
@@ -351,6 +444,79 @@ func TestLazyDfaAnnotatedStateClone(t *testing.T) {
 	}
 }
 
+func TestLazyDfaAnnotatedStateCloneDeep(t *testing.T) {
+	states := newCatBatMachine(t)
+	startState := states[0].(*LazyDfaAnnotatedState)
+
+	shallowClone := startState.Clone()
+	for _, edge := range []interface{}{"c", "b"} {
+		if dest := shallowClone.FollowEdge(edge); len(dest) != 1 ||
+			dest[0] != states[1] {
+			t.Errorf("Expected shallow clone to share destination %v, got %v",
+				states[1], dest)
+		}
+	}
+
+	deepClone := startState.CloneDeep()
+	if MachineString(deepClone) != MachineString(startState) {
+		t.Errorf("Expected %q, got %q", MachineString(startState),
+			MachineString(deepClone))
+	}
+	cDest := deepClone.FollowEdge("c")
+	bDest := deepClone.FollowEdge("b")
+	if len(cDest) != 1 || len(bDest) != 1 {
+		t.Fatalf("Expected deep clone to keep edges, got %v, %v", cDest,
+			bDest)
+	} else if cDest[0] != bDest[0] {
+		t.Errorf("Expected shared destination to stay shared, got %v, %v",
+			cDest[0], bDest[0])
+	}
+	clonedStates := OrderedStates(deepClone)
+	for i, clonedState := range clonedStates {
+		if clonedState == states[i] {
+			t.Errorf("Expected deep clone not to share state %d",
+				clonedState.GetId())
+		}
+	}
+
+	if err := clonedStates[3].AddAnnotation("end"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	addTestEdge(t, clonedStates[3], "s", clonedStates[1])
+	if annotations, err := states[3].GetAnnotations(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if len(annotations) != 0 {
+		t.Errorf("Deep clone modification changed annotations to %v",
+			annotations)
+	}
+	if dest := states[3].FollowEdge("s"); len(dest) != 0 {
+		t.Errorf("Deep clone modification added edge to %v", dest)
+	}
+}
+
+func TestLazyDfaAnnotatedStateString(t *testing.T) {
+	testStateA := NewLazyDfaAnnotatedState(1, nil, nil)
+	testStateB := NewLazyDfaAnnotatedState(2, nil, nil)
+
+	if str := testStateA.String(); str != "1:" {
+		t.Errorf("Expected \"1:\", got %q", str)
+	}
+	for _, edge := range []interface{}{"c", "a", "b"} {
+		if err := testStateA.AddEdge(edge, testStateB); err != nil {
+			t.Errorf("Error while adding edge: %q", err)
+		}
+	}
+	for _, annotation := range []interface{}{"y", "x"} {
+		if err := testStateA.AddAnnotation(annotation); err != nil {
+			t.Errorf("Error while adding annotation: %q", err)
+		}
+	}
+	expected := "1 {x,y}: a->2 b->2 c->2"
+	if str := testStateA.String(); str != expected {
+		t.Errorf("Expected %q, got %q", expected, str)
+	}
+}
+
 func TestLazyDfaAnnotatedStateType(t *testing.T) {
 	var testStateA State = NewLazyDfaAnnotatedState(1, nil, nil)
 
@@ -358,3 +524,409 @@ func TestLazyDfaAnnotatedStateType(t *testing.T) {
 		t.Errorf("Expected StateType %d, got %d", LAZYDFAANNOTATED, stateType)
 	}
 }
+
+func TestLazyDfaAnnotatedStateUserData(t *testing.T) {
+	sharedCodecHandle := new(codec.BincHandle)
+	sharedCodecHandle.Canonical = true
+	sharedHashFunc := fnv.New32()
+
+	var testStateA UserDataState = NewLazyDfaAnnotatedState(1,
+		sharedCodecHandle, sharedHashFunc)
+	var testStateB State = NewLazyDfaAnnotatedState(2, sharedCodecHandle,
+		sharedHashFunc)
+
+	if _, present := testStateA.GetUserData("count"); present {
+		t.Errorf("Expected no user data on initialization")
+	}
+	if userData := testStateA.(*LazyDfaAnnotatedState).UserData; userData !=
+		nil {
+		t.Errorf("Expected no user data map until user data is set")
+	}
+	if clone := testStateB.Clone().(*LazyDfaAnnotatedState); clone.UserData !=
+		nil {
+		t.Errorf("Expected no user data map in clone without user data")
+	}
+
+	for i := 1; i <= 3; i++ {
+		count, _ := testStateA.GetUserData("count")
+		if count == nil {
+			count = 0
+		}
+		testStateA.SetUserData("count", count.(int)+1)
+		if count, present := testStateA.GetUserData("count"); !present {
+			t.Errorf("Expected user data to be present")
+		} else if count != i {
+			t.Errorf("User data %v, want %d", count, i)
+		}
+	}
+
+	if a_hash, err := testStateA.IsomorphismHash(); err != nil {
+		t.Errorf("Error while getting IsomorphismHash: %q", err)
+	} else if b_hash, err := testStateB.IsomorphismHash(); err != nil {
+		t.Errorf("Error while getting IsomorphismHash: %q", err)
+	} else if a_hash != b_hash {
+		t.Errorf("Expected user data to be excluded from hash: %d, %d",
+			a_hash, b_hash)
+	}
+
+	testStateC := testStateA.Clone().(UserDataState)
+	testStateC.SetUserData("count", 10)
+	if count, _ := testStateA.GetUserData("count"); count != 3 {
+		t.Errorf("Clone modification changed user data to %v, want 3", count)
+	}
+}
+
+func TestLazyDfaAnnotatedStateIncrementalHash(t *testing.T) {
+	for _, incremental := range []bool{false, true} {
+		factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+		factory.IncrementalHash = incremental
+		states := newTestStates(t, factory, 5)
+
+		addTestEdge(t, states[0], "a", states[3])
+		addTestEdge(t, states[0], "b", states[4])
+		addTestEdge(t, states[1], "b", states[4])
+		addTestEdge(t, states[1], "a", states[3])
+		addTestEdge(t, states[2], "a", states[3])
+		addTestEdge(t, states[2], "b", states[3])
+
+		hashes := make([]interface{}, 0, len(states))
+		for _, state := range states {
+			if hash, err := state.IsomorphismHash(); err != nil {
+				t.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+			} else {
+				hashes = append(hashes, hash)
+			}
+		}
+		if hashes[0] != hashes[1] {
+			t.Errorf("Incremental %t: expected same hash for same edges "+
+				"added in different order: %d, %d", incremental, hashes[0],
+				hashes[1])
+		}
+		if hashes[0] == hashes[2] {
+			t.Errorf("Incremental %t: expected different hashes for "+
+				"different destinations: %d", incremental, hashes[0])
+		}
+		if hashes[3] != hashes[4] {
+			t.Errorf("Incremental %t: expected same hash for states "+
+				"without edges: %d, %d", incremental, hashes[3], hashes[4])
+		}
+
+		register := NewCollisionSafeHashMapRegister()
+		for i, state := range states {
+			expected := state
+			if i == 1 || i == 4 {
+				expected = states[i-1]
+			}
+			if ref, err := register.GetEquivalenceClass(state); err != nil {
+				t.Errorf("Error while getting equivalence class: %q", err)
+			} else if ref != expected {
+				t.Errorf("Incremental %t: state %d merged into %d, want %d",
+					incremental, state.GetId(), ref.GetId(), expected.GetId())
+			}
+		}
+
+		if err := states[2].RemoveEdge("b", states[3]); err != nil {
+			t.Errorf("Error while removing edge: %q", err)
+		}
+		addTestEdge(t, states[2], "b", states[4])
+		if hash, err := states[2].IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if hash != hashes[0] {
+			t.Errorf("Incremental %t: expected hash %d after rewiring, got "+
+				"%d", incremental, hashes[0], hash)
+		}
+	}
+}
+
+func benchmarkIsomorphismHash(b *testing.B, incremental bool) {
+	sharedCodecHandle := new(codec.BincHandle)
+	sharedCodecHandle.Canonical = true
+	sharedHashFunc := fnv.New32()
+
+	state := NewLazyDfaAnnotatedState(0, sharedCodecHandle, sharedHashFunc)
+	state.IncrementalHash = incremental
+	destination := NewLazyDfaAnnotatedState(1, sharedCodecHandle,
+		sharedHashFunc)
+	for edge := 'a'; edge < 'z'; edge++ {
+		if err := state.AddEdge(edge, destination); err != nil {
+			b.Fatalf("Error while adding edge: %q", err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := state.AddEdge('z', destination); err != nil {
+			b.Fatalf("Error while adding edge: %q", err)
+		}
+		if _, err := state.IsomorphismHash(); err != nil {
+			b.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+		}
+		if err := state.RemoveEdge('z', destination); err != nil {
+			b.Fatalf("Error while removing edge: %q", err)
+		}
+	}
+}
+
+func BenchmarkLazyDfaAnnotatedStateCanonicalHash(b *testing.B) {
+	benchmarkIsomorphismHash(b, false)
+}
+
+func BenchmarkLazyDfaAnnotatedStateIncrementalHash(b *testing.B) {
+	benchmarkIsomorphismHash(b, true)
+}
+
+func TestLazyDfaAnnotatedStateSharedEncoder(t *testing.T) {
+	allocatingFactory := newTestStateFactory(t)
+	reusingFactory := newTestStateFactory(t).(*EncodeHashStateFactory)
+	reusingFactory.ReuseEncoder = true
+
+	words := []string{"cat", "cats", "bat", "dog", "dot", "do"}
+	allocatingStates := OrderedStates(newTestTrie(t, allocatingFactory,
+		words))
+	reusingStates := OrderedStates(newTestTrie(t, reusingFactory, words))
+	if len(allocatingStates) != len(reusingStates) {
+		t.Fatalf("State counts differ: %d, %d", len(allocatingStates),
+			len(reusingStates))
+	}
+
+	for i, state := range reusingStates {
+		lazyState := state.(*LazyDfaAnnotatedState)
+		if lazyState.SharedEncoder != reusingFactory.SharedEncoder {
+			t.Errorf("State %d does not use the factory's encoder",
+				state.GetId())
+		}
+		if expected, err := allocatingStates[i].IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if hash, err := state.IsomorphismHash(); err != nil {
+			t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+		} else if hash != expected {
+			t.Errorf("State %d hash %d, want %d", state.GetId(), hash,
+				expected)
+		}
+	}
+
+	var nilEncoderState State = NewLazyDfaAnnotatedState(1, nil, nil)
+	nilEncoderState.(*LazyDfaAnnotatedState).SharedEncoder =
+		NewReusableEncoder(nil)
+	if _, err := nilEncoderState.IsomorphismHash(); err != ErrNilEncoder {
+		t.Errorf("Expected %q, got %q", ErrNilEncoder, err)
+	}
+}
+
+func benchmarkSharedEncoderHash(b *testing.B, reuseEncoder bool) {
+	sharedCodecHandle := new(codec.BincHandle)
+	sharedCodecHandle.Canonical = true
+	sharedHashFunc := fnv.New32()
+
+	state := NewLazyDfaAnnotatedState(0, sharedCodecHandle, sharedHashFunc)
+	if reuseEncoder {
+		state.SharedEncoder = NewReusableEncoder(sharedCodecHandle)
+	}
+	destination := NewLazyDfaAnnotatedState(1, sharedCodecHandle,
+		sharedHashFunc)
+	for edge := 'a'; edge < 'e'; edge++ {
+		if err := state.AddEdge(edge, destination); err != nil {
+			b.Fatalf("Error while adding edge: %q", err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := state.IsomorphismHash(); err != nil {
+			b.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+		}
+	}
+}
+
+func BenchmarkLazyDfaAnnotatedStateAllocatingHash(b *testing.B) {
+	benchmarkSharedEncoderHash(b, false)
+}
+
+func BenchmarkLazyDfaAnnotatedStateSharedEncoderHash(b *testing.B) {
+	benchmarkSharedEncoderHash(b, true)
+}
+
+func TestLazyDfaAnnotatedStateFreezeAnnotations(t *testing.T) {
+	state := NewLazyDfaAnnotatedState(1, nil, nil)
+	for _, annotation := range []interface{}{"noun", 3, "1", 1, "adj"} {
+		if err := state.AddAnnotation(annotation); err != nil {
+			t.Errorf("Error while adding annotation: %q", err)
+		}
+	}
+	expected, err := state.GetAnnotationsSorted()
+	if err != nil {
+		t.Fatalf("Error while getting annotations: %q", err)
+	}
+
+	state.FreezeAnnotations()
+	if state.Annotations != nil {
+		t.Errorf("Expected annotation map to be released, got %v",
+			state.Annotations)
+	}
+	if annotations, err := state.GetAnnotationsSorted(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("Expected %v, got %v", expected, annotations)
+	}
+
+	if err := state.RemoveAnnotation(1); err != nil {
+		t.Errorf("Error while removing annotation: %q", err)
+	}
+	if err := state.RemoveAnnotation(1); err != ErrAnnotationInvalid {
+		t.Errorf("Expected %q, got %q", ErrAnnotationInvalid, err)
+	}
+	for _, annotation := range []interface{}{"verb", "noun"} {
+		if err := state.AddAnnotation(annotation); err != nil {
+			t.Errorf("Error while adding annotation: %q", err)
+		}
+	}
+	expected = []interface{}{"1", 3, "adj", "noun", "verb"}
+	if annotations, err := state.GetAnnotationsSorted(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("Expected %v, got %v", expected, annotations)
+	}
+
+	clone := state.Clone().(*LazyDfaAnnotatedState)
+	if err := clone.AddAnnotation("pl"); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	if annotations, err := state.GetAnnotations(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if len(annotations) != len(expected) {
+		t.Errorf("Clone modification changed annotations to %v",
+			annotations)
+	}
+}
+
+// Reports the heap retained per state holding a few annotations.
+func benchmarkAnnotationMemory(b *testing.B, freeze bool) {
+	const stateCount = 1000
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		states := make([]*LazyDfaAnnotatedState, stateCount)
+		for j := range states {
+			states[j] = NewLazyDfaAnnotatedState(StateId(j), nil, nil)
+			for _, annotation := range []interface{}{"noun", "pl", j} {
+				states[j].AddAnnotation(annotation)
+			}
+			if freeze {
+				states[j].FreezeAnnotations()
+			}
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/stateCount,
+			"bytes/state")
+		runtime.KeepAlive(states)
+	}
+}
+
+func BenchmarkLazyDfaAnnotatedStateAnnotationMap(b *testing.B) {
+	benchmarkAnnotationMemory(b, false)
+}
+
+func BenchmarkLazyDfaAnnotatedStateFrozenAnnotations(b *testing.B) {
+	benchmarkAnnotationMemory(b, true)
+}
+
+func TestLazyDfaAnnotatedStateStableEdges(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	testCases := []struct {
+		state    State
+		expected []interface{}
+	}{
+		// Binc encodes short strings with their length first, and small
+		// integers after strings.
+		{NewLazyDfaAnnotatedState(1, codecHandle, nil),
+			[]interface{}{300, "b", "c", "ab", 7}},
+		{NewSortedSliceDfaAnnotatedState(1, codecHandle, nil),
+			[]interface{}{300, "b", "c", "ab", 7}},
+		{NewLazyDfaAnnotatedState(1, nil, nil),
+			[]interface{}{300, 7, "ab", "b", "c"}},
+	}
+	for _, testCase := range testCases {
+		destination := NewLazyDfaAnnotatedState(2, nil, nil)
+		for _, edge := range []interface{}{"b", "ab", 7, "c", 300} {
+			addTestEdge(t, testCase.state, edge, destination)
+		}
+
+		for i := 0; i < 10; i++ {
+			edges := testCase.state.StableEdges()
+			transitions := make([]interface{}, 0, len(edges))
+			for _, edge := range edges {
+				if edge.Destination != destination {
+					t.Errorf("Expected destination %v, got %v", destination,
+						edge.Destination)
+				}
+				transitions = append(transitions, edge.Transition)
+			}
+			if !reflect.DeepEqual(transitions, testCase.expected) {
+				t.Errorf("Expected %v, got %v", testCase.expected,
+					transitions)
+			}
+		}
+	}
+}
+
+func TestStableEdgesTransitionsEncodingAlike(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	insertionOrders := [][]interface{}{
+		{int64(1), 1, "a", int8(1)},
+		{int8(1), "a", 1, int64(1)},
+		{1, int8(1), int64(1), "a"},
+	}
+	newStates := []func() State{
+		func() State { return NewLazyDfaAnnotatedState(1, codecHandle, nil) },
+		func() State {
+			return NewSortedSliceDfaAnnotatedState(1, codecHandle, nil)
+		},
+		func() State {
+			return NewHybridDfaAnnotatedState(1, codecHandle, nil, 8)
+		},
+		func() State {
+			return NewHybridDfaAnnotatedState(1, codecHandle, nil, 1)
+		},
+	}
+	expected := []interface{}{"a", 1, int64(1), int8(1)}
+	for _, newState := range newStates {
+		for _, insertionOrder := range insertionOrders {
+			testState := newState()
+			for i, edge := range insertionOrder {
+				addTestEdge(t, testState, edge,
+					NewLazyDfaAnnotatedState(StateId(i+2), nil, nil))
+			}
+			for i := 0; i < 10; i++ {
+				transitions := make([]interface{}, 0, len(expected))
+				for _, edge := range testState.StableEdges() {
+					transitions = append(transitions, edge.Transition)
+				}
+				if !reflect.DeepEqual(transitions, expected) {
+					t.Errorf("Expected %#v, got %#v", expected, transitions)
+				}
+			}
+		}
+	}
+
+	testState := NewLazyDfaAnnotatedState(1, nil, nil)
+	for i, edge := range insertionOrders[0] {
+		addTestEdge(t, testState, edge,
+			NewLazyDfaAnnotatedState(StateId(i+2), nil, nil))
+	}
+	expected = []interface{}{1, int64(1), int8(1), "a"}
+	for i := 0; i < 10; i++ {
+		transitions := make([]interface{}, 0, len(expected))
+		for _, edge := range testState.StableEdges() {
+			transitions = append(transitions, edge.Transition)
+		}
+		if !reflect.DeepEqual(transitions, expected) {
+			t.Errorf("Expected %#v, got %#v", expected, transitions)
+		}
+	}
+}
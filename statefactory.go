@@ -1,7 +1,9 @@
 package wilddawg
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"hash"
 
 	"github.com/ugorji/go/codec"
@@ -14,7 +16,12 @@ const (
 )
 
 var (
-	ErrInvalidStateType = errors.New("Invalid StateType")
+	ErrInvalidStateType  = errors.New("Invalid StateType")
+	ErrDuplicateStateId  = errors.New("StateId has already been issued")
+	ErrNonCanonicalCodec = errors.New("Codec handle does not encode " +
+		"canonically")
+	ErrUnstableEncoding = errors.New("Repeated encodings of the same " +
+		"machine edges differ")
 )
 
 /*
@@ -31,30 +38,89 @@ type StateFactory interface {
 }
 
 // This implementation is a state factory that can initialize States that need
-// an encoding and hashing function.
+// an encoding and hashing function. Its options apply to the states it creates
+// from then on.
 type EncodeHashStateFactory struct {
-	IdCounter        StateId
-	Encoding         codec.Handle
-	HashFunc         hash.Hash32
+	IdCounter StateId
+	Encoding  codec.Handle
+	HashFunc  hash.Hash32
+	// Passed on to new states; see LazyDfaAnnotatedState for its contract.
+	HashFunc2        hash.Hash32
 	DefaultStateType StateType
 	Type             StateFactoryType
+	// When set, the factory remembers every Id it has issued in LiveIds and
+	// refuses to issue one again. Ids are only forgotten through ReleaseId, so
+	// LiveIds otherwise grows with every state issued, including states later
+	// discarded during minimization.
+	TrackLiveIds bool
+	LiveIds      map[StateId]bool
+	// When set, new states hash incrementally; see LazyDfaAnnotatedState.
+	IncrementalHash bool
+	// When set, new states share SharedEncoder, which is only safe for
+	// single-goroutine builds.
+	ReuseEncoder  bool
+	SharedEncoder *ReusableEncoder
+	// When set, new states share SymbolTable, so equal transition symbols
+	// across the machine are stored once.
+	InternSymbols bool
+	SymbolTable   *SymbolTable
+	// The number of edges a new HybridDfaAnnotatedState keeps in a slice
+	// before moving them into a map.
+	SmallEdgeLimit int
+	// Passed on to new states; see LazyDfaAnnotatedState for its contract.
+	TransitionKeyFunc TransitionKeyFunc
+	// The number of edges the edge map of a new state has room for, which
+	// saves growing the maps when most states are known to have about that
+	// many edges. Every new map-backed state gets the larger map, so a hint
+	// well above the typical degree, as in a trie with many leaves, costs
+	// memory instead. A new HybridDfaAnnotatedState only uses it once it
+	// moves its edges into a map.
+	EdgeCapacityHint int
+	// Passed on to new LazyDfaEdgeDataStates. Set by NewEncodeHashStateFactory.
+	HashEdgeData bool
+	// Passed on to new states built on LazyDfaAnnotatedState. It is only for
+	// bulk loading machines known to be well formed; see
+	// LazyDfaAnnotatedState for the danger.
+	UnsafeNoDupCheck bool
 }
 
+// The encoding must encode canonically, since IsomorphismHash hashes encoded
+// edge maps and map order would otherwise make equal states hash differently.
+// For the handles provided by the codec package, NewEncodeHashStateFactory
+// returns ErrNonCanonicalCodec unless their Canonical option is set. Other
+// handle types cannot be checked and are trusted to be canonical.
 func NewEncodeHashStateFactory(encoding codec.Handle, hashFunc hash.Hash32,
 	defaultStateType StateType) (*EncodeHashStateFactory, error) {
 	switch defaultStateType {
-	case LAZYDFAANNOTATED:
+	case LAZYDFAANNOTATED, LAZYDFAKVANNOTATED, HYBRIDDFAANNOTATED,
+		LAZYDFAEDGEDATA:
 		break
 	default:
 		return nil, ErrInvalidStateType
 	}
+	if canonical, known := canonicalOption(encoding); known && !*canonical {
+		return nil, ErrNonCanonicalCodec
+	}
 
 	newFactory := &EncodeHashStateFactory{
-		IdCounter:        0,
-		Encoding:         encoding,
-		HashFunc:         hashFunc,
-		DefaultStateType: defaultStateType,
-		Type:             ENCODEHASH,
+		IdCounter:         0,
+		Encoding:          encoding,
+		HashFunc:          hashFunc,
+		HashFunc2:         nil,
+		DefaultStateType:  defaultStateType,
+		Type:              ENCODEHASH,
+		TrackLiveIds:      false,
+		LiveIds:           nil,
+		IncrementalHash:   false,
+		ReuseEncoder:      false,
+		SharedEncoder:     nil,
+		InternSymbols:     false,
+		SymbolTable:       nil,
+		SmallEdgeLimit:    DefaultSmallEdgeLimit,
+		TransitionKeyFunc: nil,
+		EdgeCapacityHint:  0,
+		HashEdgeData:      true,
+		UnsafeNoDupCheck:  false,
 	}
 	return newFactory, nil
 }
@@ -64,6 +130,9 @@ func (f *EncodeHashStateFactory) GetIdCounter() StateId {
 }
 
 func (f *EncodeHashStateFactory) SetIdCounter(countPos StateId) error {
+	if f.TrackLiveIds && f.LiveIds[countPos] {
+		return ErrDuplicateStateId
+	}
 	f.IdCounter = countPos
 	return nil
 }
@@ -74,7 +143,8 @@ func (f *EncodeHashStateFactory) GetDefaultStateType() StateType {
 
 func (f *EncodeHashStateFactory) SetDefaultStateType(newType StateType) error {
 	switch newType {
-	case LAZYDFAANNOTATED:
+	case LAZYDFAANNOTATED, LAZYDFAKVANNOTATED, HYBRIDDFAANNOTATED,
+		LAZYDFAEDGEDATA:
 		f.DefaultStateType = newType
 	default:
 		return ErrInvalidStateType
@@ -85,28 +155,197 @@ func (f *EncodeHashStateFactory) SetDefaultStateType(newType StateType) error {
 func (f *EncodeHashStateFactory) NewState() (State, error) {
 	var newState State
 
+	if err := f.checkIdCounter(); err != nil {
+		return nil, err
+	}
 	switch f.DefaultStateType {
 	case LAZYDFAANNOTATED:
-		newState = NewLazyDfaAnnotatedState(f.IdCounter, f.Encoding, f.HashFunc)
+		lazyState := NewLazyDfaAnnotatedStateWithCapacity(f.IdCounter,
+			f.Encoding, f.HashFunc, f.EdgeCapacityHint)
+		lazyState.IncrementalHash = f.IncrementalHash
+		lazyState.SharedEncoder = f.sharedEncoder()
+		lazyState.SymbolTable = f.symbolTable()
+		lazyState.TransitionKeyFunc = f.TransitionKeyFunc
+		lazyState.HashFunc2 = f.HashFunc2
+		lazyState.UnsafeNoDupCheck = f.UnsafeNoDupCheck
+		newState = lazyState
+	case LAZYDFAKVANNOTATED:
+		kvState := NewLazyDfaKVAnnotatedStateWithCapacity(f.IdCounter,
+			f.Encoding, f.HashFunc, f.EdgeCapacityHint)
+		kvState.IncrementalHash = f.IncrementalHash
+		kvState.SharedEncoder = f.sharedEncoder()
+		kvState.SymbolTable = f.symbolTable()
+		kvState.TransitionKeyFunc = f.TransitionKeyFunc
+		kvState.HashFunc2 = f.HashFunc2
+		kvState.UnsafeNoDupCheck = f.UnsafeNoDupCheck
+		newState = kvState
+	case HYBRIDDFAANNOTATED:
+		hybridState := NewHybridDfaAnnotatedState(f.IdCounter, f.Encoding,
+			f.HashFunc, f.SmallEdgeLimit)
+		hybridState.IncrementalHash = f.IncrementalHash
+		hybridState.SharedEncoder = f.sharedEncoder()
+		hybridState.SymbolTable = f.symbolTable()
+		hybridState.TransitionKeyFunc = f.TransitionKeyFunc
+		hybridState.HashFunc2 = f.HashFunc2
+		hybridState.EdgeCapacityHint = f.EdgeCapacityHint
+		newState = hybridState
+	case LAZYDFAEDGEDATA:
+		dataState := NewLazyDfaEdgeDataStateWithCapacity(f.IdCounter,
+			f.Encoding, f.HashFunc, f.EdgeCapacityHint)
+		dataState.IncrementalHash = f.IncrementalHash
+		dataState.SharedEncoder = f.sharedEncoder()
+		dataState.SymbolTable = f.symbolTable()
+		dataState.TransitionKeyFunc = f.TransitionKeyFunc
+		dataState.HashFunc2 = f.HashFunc2
+		dataState.UnsafeNoDupCheck = f.UnsafeNoDupCheck
+		dataState.HashEdgeData = f.HashEdgeData
+		newState = dataState
 	default:
 		return nil, ErrInvalidStateType
 	}
-	f.IdCounter += 1
+	f.issueId()
 
 	return newState, nil
 }
 
 func (f *EncodeHashStateFactory) CloneState(orig State) (State, error) {
+	if err := f.checkIdCounter(); err != nil {
+		return nil, err
+	}
 	clone := orig.Clone()
 
 	if err := clone.SetId(f.IdCounter); err != nil {
 		return nil, err
 	}
-	f.IdCounter += 1
+	f.issueId()
 
 	return clone, nil
 }
 
+// Forgets that an Id was issued, so that it may be issued again, e.g. once the
+// state holding it has been discarded during minimization. Releasing an Id
+// that is still in use defeats TrackLiveIds.
+func (f *EncodeHashStateFactory) ReleaseId(id StateId) {
+	delete(f.LiveIds, id)
+}
+
 func (f *EncodeHashStateFactory) GetStateFactoryType() StateFactoryType {
 	return f.Type
 }
+
+func (f *EncodeHashStateFactory) checkIdCounter() error {
+	if f.TrackLiveIds && f.LiveIds[f.IdCounter] {
+		return ErrDuplicateStateId
+	}
+	return nil
+}
+
+func (f *EncodeHashStateFactory) issueId() {
+	if f.TrackLiveIds {
+		if f.LiveIds == nil {
+			f.LiveIds = make(map[StateId]bool)
+		}
+		f.LiveIds[f.IdCounter] = true
+	}
+	f.IdCounter += 1
+}
+
+func (f *EncodeHashStateFactory) sharedEncoder() *ReusableEncoder {
+	if !f.ReuseEncoder {
+		return nil
+	}
+	if f.SharedEncoder == nil {
+		f.SharedEncoder = NewReusableEncoder(f.Encoding)
+	}
+	return f.SharedEncoder
+}
+
+func (f *EncodeHashStateFactory) symbolTable() *SymbolTable {
+	if !f.InternSymbols {
+		return nil
+	}
+	if f.SymbolTable == nil {
+		f.SymbolTable = NewSymbolTable()
+	}
+	return f.SymbolTable
+}
+
+// Sets the Canonical option of a handle provided by the codec package, e.g.
+// before passing it to NewEncodeHashStateFactory. Other handle types return
+// ErrNonCanonicalCodec, as they cannot be made canonical here.
+func SetCanonical(encoding codec.Handle) error {
+	if canonical, known := canonicalOption(encoding); !known {
+		return ErrNonCanonicalCodec
+	} else {
+		*canonical = true
+	}
+	return nil
+}
+
+// Checks that each handle can be used to hash the state reproducibly. Handles
+// provided by the codec package must have their Canonical option set. For every
+// handle the state's machine edges are also encoded repeatedly, keyed by its
+// TransitionKeyFunc as IsomorphismHash does, and the encodings must be
+// identical, which catches other handle types that encode maps in iteration
+// order. The state needs several edges for this to be meaningful. The first
+// failure is returned, wrapped with the index of the handle.
+func VerifyHashStability(s State, handles []codec.Handle) error {
+	const encodingRounds = 8
+	machineEdges := s.MachineEdges()
+	if keyedState, ok := s.(interface {
+		keyedMachineEdges() map[interface{}]StateId
+	}); ok {
+		machineEdges = keyedState.keyedMachineEdges()
+	}
+	for i, encoding := range handles {
+		if encoding == nil {
+			return fmt.Errorf("handle %d: %w", i, ErrNilEncoder)
+		}
+		if canonical, known := canonicalOption(encoding); known &&
+			!*canonical {
+			return fmt.Errorf("handle %d: %w", i, ErrNonCanonicalCodec)
+		}
+		var first []byte
+		for round := 0; round < encodingRounds; round++ {
+			encoded := make([]byte, 0, 64)
+			encoder := codec.NewEncoderBytes(&encoded, encoding)
+			if err := encoder.Encode(machineEdges); err != nil {
+				return fmt.Errorf("handle %d: %w", i, err)
+			}
+			if round == 0 {
+				first = encoded
+			} else if !bytes.Equal(encoded, first) {
+				return fmt.Errorf("handle %d: %w", i, ErrUnstableEncoding)
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the Canonical option of a handle provided by the codec package, and
+// false for nil and other handle types.
+func canonicalOption(encoding codec.Handle) (*bool, bool) {
+	switch h := encoding.(type) {
+	case *codec.BincHandle:
+		if h != nil {
+			return &h.Canonical, true
+		}
+	case *codec.CborHandle:
+		if h != nil {
+			return &h.Canonical, true
+		}
+	case *codec.JsonHandle:
+		if h != nil {
+			return &h.Canonical, true
+		}
+	case *codec.MsgpackHandle:
+		if h != nil {
+			return &h.Canonical, true
+		}
+	case *codec.SimpleHandle:
+		if h != nil {
+			return &h.Canonical, true
+		}
+	}
+	return nil, false
+}
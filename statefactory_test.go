@@ -0,0 +1,499 @@
+package wilddawg
+
+import (
+	"errors"
+	"hash/fnv"
+	"reflect"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestEncodeHashStateFactoryTrackLiveIds(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	factory, err := NewEncodeHashStateFactory(codecHandle, fnv.New32(),
+		LAZYDFAANNOTATED)
+	if err != nil {
+		t.Fatalf("Error while creating state factory: %q", err)
+	}
+	factory.TrackLiveIds = true
+
+	stateA, err := factory.NewState()
+	if err != nil {
+		t.Fatalf("Error while creating state: %q", err)
+	}
+	if _, err := factory.CloneState(stateA); err != nil {
+		t.Fatalf("Error while cloning state: %q", err)
+	}
+
+	if err := factory.SetIdCounter(stateA.GetId()); err != ErrDuplicateStateId {
+		t.Errorf("Expected %q, got %q", ErrDuplicateStateId, err)
+	}
+	if err := factory.SetIdCounter(1); err != ErrDuplicateStateId {
+		t.Errorf("Expected %q, got %q", ErrDuplicateStateId, err)
+	}
+	if err := factory.SetIdCounter(5); err != nil {
+		t.Errorf("Error while setting Id counter: %q", err)
+	}
+	if state, err := factory.NewState(); err != nil {
+		t.Errorf("Error while creating state: %q", err)
+	} else if state.GetId() != 5 {
+		t.Errorf("State Id: %d, want 5", state.GetId())
+	}
+
+	factory.TrackLiveIds = false
+	if err := factory.SetIdCounter(stateA.GetId()); err != nil {
+		t.Errorf("Error while setting Id counter without tracking: %q", err)
+	}
+	factory.TrackLiveIds = true
+	if _, err := factory.NewState(); err != ErrDuplicateStateId {
+		t.Errorf("Expected %q, got %q", ErrDuplicateStateId, err)
+	}
+	if _, err := factory.CloneState(stateA); err != ErrDuplicateStateId {
+		t.Errorf("Expected %q, got %q", ErrDuplicateStateId, err)
+	}
+
+	factory.ReleaseId(stateA.GetId())
+	if state, err := factory.NewState(); err != nil {
+		t.Errorf("Error while creating state: %q", err)
+	} else if state.GetId() != stateA.GetId() {
+		t.Errorf("State Id: %d, want %d", state.GetId(), stateA.GetId())
+	}
+
+	literalFactory := &EncodeHashStateFactory{
+		Encoding:         codecHandle,
+		HashFunc:         fnv.New32(),
+		DefaultStateType: LAZYDFAANNOTATED,
+		TrackLiveIds:     true,
+	}
+	if state, err := literalFactory.NewState(); err != nil {
+		t.Errorf("Error while creating state: %q", err)
+	} else if err := literalFactory.SetIdCounter(
+		state.GetId()); err != ErrDuplicateStateId {
+		t.Errorf("Expected %q, got %q", ErrDuplicateStateId, err)
+	}
+}
+
+func TestEncodeHashStateFactoryDefaultStateType(t *testing.T) {
+	codecHandle := new(codec.BincHandle)
+	codecHandle.Canonical = true
+	factory, err := NewEncodeHashStateFactory(codecHandle, fnv.New32(),
+		LAZYDFAKVANNOTATED)
+	if err != nil {
+		t.Fatalf("Error while creating state factory: %q", err)
+	}
+
+	if state, err := factory.NewState(); err != nil {
+		t.Errorf("Error while creating state: %q", err)
+	} else if _, ok := state.(KVAnnotatedState); !ok {
+		t.Errorf("Expected a KVAnnotatedState, got %T", state)
+	}
+
+	if err := factory.SetDefaultStateType(LAZYDFAANNOTATED); err != nil {
+		t.Errorf("Error while setting default state type: %q", err)
+	}
+	if state, err := factory.NewState(); err != nil {
+		t.Errorf("Error while creating state: %q", err)
+	} else if stateType := state.GetStateType(); stateType != LAZYDFAANNOTATED {
+		t.Errorf("Expected StateType %d, got %d", LAZYDFAANNOTATED, stateType)
+	}
+
+	if err := factory.SetDefaultStateType(SORTEDSLICEDFAANNOTATED); err !=
+		ErrInvalidStateType {
+		t.Errorf("Expected %q, got %q", ErrInvalidStateType, err)
+	}
+}
+
+func TestEncodeHashStateFactoryCloneState(t *testing.T) {
+	factory := newTestStateFactory(t)
+	states := newTestStates(t, factory, 2)
+	addTestEdge(t, states[0], "a", states[1])
+	if err := states[0].AddAnnotation(1); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+
+	clone, err := factory.CloneState(states[0])
+	if err != nil {
+		t.Fatalf("Error while cloning state: %q", err)
+	}
+	if clone.GetId() == states[0].GetId() {
+		t.Errorf("Expected clone to get a fresh Id, got %d", clone.GetId())
+	}
+	if err := clone.AddAnnotation(2); err != nil {
+		t.Errorf("Error while adding annotation: %q", err)
+	}
+	addTestEdge(t, clone, "b", states[1])
+	if annotations, err := states[0].GetAnnotations(); err != nil {
+		t.Errorf("Error while getting annotations: %q", err)
+	} else if !slicesSameValues(annotations, []interface{}{1}) {
+		t.Errorf("Clone modification changed annotations to %v",
+			annotations)
+	}
+	if dest := states[0].FollowEdge("b"); len(dest) != 0 {
+		t.Errorf("Clone modification added edge to %v", dest)
+	}
+}
+
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestEncodeHashStateFactoryInternSymbols(t *testing.T) {
+	factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+	factory.InternSymbols = true
+	states := newTestStates(t, factory, 3)
+
+	// Build equal symbols with distinct backing arrays, as if decoded from
+	// separate input lines.
+	symbolA := strings.Repeat("ab", 2)
+	symbolB := strings.Repeat("ab", 2)
+	if stringData(symbolA) == stringData(symbolB) {
+		t.Fatalf("Expected test symbols to have distinct backing arrays")
+	}
+	addTestEdge(t, states[0], symbolA, states[2])
+	addTestEdge(t, states[1], symbolB, states[2])
+
+	var stored []string
+	for _, state := range states[:2] {
+		for edge := range state.(*LazyDfaAnnotatedState).Edges {
+			stored = append(stored, edge.(string))
+		}
+	}
+	if stringData(stored[0]) != stringData(stored[1]) {
+		t.Errorf("Expected equal symbols to share one interned value")
+	}
+	if stringData(stored[0]) != stringData(symbolA) {
+		t.Errorf("Expected first symbol to become the interned value")
+	}
+
+	register := NewCollisionSafeHashMapRegister()
+	if ref, err := register.GetEquivalenceClass(states[0]); err != nil {
+		t.Errorf("Error while getting equivalence class: %q", err)
+	} else if ref != states[0] {
+		t.Errorf("Expected %v, got %v", states[0], ref)
+	}
+	if ref, err := register.GetEquivalenceClass(states[1]); err != nil {
+		t.Errorf("Error while getting equivalence class: %q", err)
+	} else if ref != states[0] {
+		t.Errorf("Expected interned states to merge, got %v", ref)
+	}
+}
+
+func TestEncodeHashStateFactoryNonCanonicalCodec(t *testing.T) {
+	for _, codecHandle := range []codec.Handle{new(codec.BincHandle),
+		new(codec.CborHandle), new(codec.MsgpackHandle)} {
+		if _, err := NewEncodeHashStateFactory(codecHandle, fnv.New32(),
+			LAZYDFAANNOTATED); err != ErrNonCanonicalCodec {
+			t.Errorf("Expected %q, got %q", ErrNonCanonicalCodec, err)
+		}
+		if err := SetCanonical(codecHandle); err != nil {
+			t.Errorf("Error while setting canonical option: %q", err)
+		}
+		if _, err := NewEncodeHashStateFactory(codecHandle, fnv.New32(),
+			LAZYDFAANNOTATED); err != nil {
+			t.Errorf("Error while creating state factory: %q", err)
+		}
+	}
+
+	if _, err := NewEncodeHashStateFactory(nil, fnv.New32(),
+		LAZYDFAANNOTATED); err != nil {
+		t.Errorf("Error while creating state factory: %q", err)
+	}
+	if err := SetCanonical(nil); err != ErrNonCanonicalCodec {
+		t.Errorf("Expected %q, got %q", ErrNonCanonicalCodec, err)
+	}
+}
+
+type testPointerSymbol struct {
+	Name string
+}
+
+func TestEncodeHashStateFactoryTransitionKeyFunc(t *testing.T) {
+	for _, keyFunc := range []TransitionKeyFunc{nil,
+		func(edge interface{}) interface{} {
+			return edge.(*testPointerSymbol).Name
+		}} {
+		for _, stateType := range []StateType{LAZYDFAANNOTATED,
+			LAZYDFAKVANNOTATED, HYBRIDDFAANNOTATED} {
+			factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+			factory.TransitionKeyFunc = keyFunc
+			if err := factory.SetDefaultStateType(stateType); err != nil {
+				t.Fatalf("Error while setting default state type: %q", err)
+			}
+			states := newTestStates(t, factory, 3)
+			symbolA := &testPointerSymbol{Name: "a"}
+			addTestEdge(t, states[0], symbolA, states[2])
+			addTestEdge(t, states[1], &testPointerSymbol{Name: "a"},
+				states[2])
+
+			if dest := states[0].FollowEdge(symbolA); len(dest) != 1 ||
+				dest[0] != states[2] {
+				t.Errorf("Expected original transition to be followable, "+
+					"got %v", dest)
+			}
+			register := NewCollisionSafeHashMapRegister()
+			if _, err := register.GetEquivalenceClass(states[0]); err != nil {
+				t.Errorf("Error while getting equivalence class: %q", err)
+			}
+			if ref, err := register.GetEquivalenceClass(states[1]); err !=
+				nil {
+				t.Errorf("Error while getting equivalence class: %q", err)
+			} else if merged := ref == states[0]; merged != (keyFunc !=
+				nil) {
+				t.Errorf("State type %d merged %t, want %t", stateType,
+					merged, keyFunc != nil)
+			}
+		}
+	}
+}
+
+func TestEncodeHashStateFactoryEdgeCapacityHint(t *testing.T) {
+	words := newRandomTestWords(300)
+	for _, stateType := range []StateType{LAZYDFAANNOTATED,
+		LAZYDFAKVANNOTATED, HYBRIDDFAANNOTATED, LAZYDFAEDGEDATA} {
+		var expectedHash uint64
+		for _, hint := range []int{0, 1, 26} {
+			factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+			factory.EdgeCapacityHint = hint
+			if err := factory.SetDefaultStateType(stateType); err != nil {
+				t.Fatalf("Error while setting default state type: %q", err)
+			}
+			startState := newTestTrie(t, factory, words)
+			if hybridState, ok := startState.(*HybridDfaAnnotatedState); ok &&
+				hybridState.EdgeCapacityHint != hint {
+				t.Errorf("Hybrid state capacity hint %d, want %d",
+					hybridState.EdgeCapacityHint, hint)
+			}
+			machineHash, err := MachineHash(startState)
+			if err != nil {
+				t.Fatalf("Error while hashing machine: %q", err)
+			}
+			if hint == 0 {
+				expectedHash = machineHash
+			} else if machineHash != expectedHash {
+				t.Errorf("State type %d with hint %d hashed to %x, want %x",
+					stateType, hint, machineHash, expectedHash)
+			}
+		}
+	}
+}
+
+// Builds states that each have 26 edges to a shared final state, as in the
+// layers of a minimized machine over a byte alphabet.
+func benchmarkEdgeCapacityHint(b *testing.B, hint int) {
+	const stateCount = 2000
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		factory := newTestStateFactory(b).(*EncodeHashStateFactory)
+		factory.EdgeCapacityHint = hint
+		sink := newTestStates(b, factory, 1)[0]
+		for _, state := range newTestStates(b, factory, stateCount) {
+			for symbol := 'a'; symbol <= 'z'; symbol++ {
+				addTestEdge(b, state, symbol, sink)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeHashStateFactoryNoEdgeCapacityHint(b *testing.B) {
+	benchmarkEdgeCapacityHint(b, 0)
+}
+
+func BenchmarkEncodeHashStateFactoryEdgeCapacityHint(b *testing.B) {
+	benchmarkEdgeCapacityHint(b, 26)
+}
+
+// An edge of a dumped machine, as a serialized machine would list it.
+type testEdgeRecord struct {
+	From       StateId
+	Transition interface{}
+	To         StateId
+}
+
+// Lists the edges of the machine reachable from the start state, state by
+// state in ascending Id order and in StableEdges order within each state.
+func dumpTestMachine(startState State) []testEdgeRecord {
+	records := make([]testEdgeRecord, 0)
+	for _, state := range OrderedStates(startState) {
+		for _, edge := range state.StableEdges() {
+			records = append(records, testEdgeRecord{
+				From:       state.GetId(),
+				Transition: edge.Transition,
+				To:         edge.Destination.GetId(),
+			})
+		}
+	}
+	return records
+}
+
+// Rebuilds a dumped machine with new states from the factory, as
+// a deserializer would, and returns the state loaded for startId.
+func loadTestMachine(t testing.TB, factory StateFactory,
+	records []testEdgeRecord, startId StateId) State {
+	loadedStates := make(map[StateId]State)
+	loadedState := func(id StateId) State {
+		if _, present := loadedStates[id]; !present {
+			loadedStates[id] = newTestStates(t, factory, 1)[0]
+		}
+		return loadedStates[id]
+	}
+	startState := loadedState(startId)
+	for _, record := range records {
+		addTestEdge(t, loadedState(record.From), record.Transition,
+			loadedState(record.To))
+	}
+	return startState
+}
+
+func TestEncodeHashStateFactoryUnsafeNoDupCheck(t *testing.T) {
+	startState := newRandomTestTrie(t, 300)
+	expectedHash, err := MachineHash(startState)
+	if err != nil {
+		t.Fatalf("Error while hashing machine: %q", err)
+	}
+	for _, noDupCheck := range []bool{false, true} {
+		factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+		factory.UnsafeNoDupCheck = noDupCheck
+		loadedStart := loadTestMachine(t, factory,
+			dumpTestMachine(startState), startState.GetId())
+		if machineHash, err := MachineHash(loadedStart); err != nil {
+			t.Errorf("Error while hashing machine: %q", err)
+		} else if machineHash != expectedHash {
+			t.Errorf("With UnsafeNoDupCheck %t, machine hashed to %x, "+
+				"want %x", noDupCheck, machineHash, expectedHash)
+		}
+
+		destination := loadedStart.FollowAllEdges()[0]
+		edge := loadedStart.EdgesTo(destination)[0]
+		err := loadedStart.AddEdge(edge, destination)
+		if noDupCheck && err != nil {
+			t.Errorf("Error while overwriting edge: %q", err)
+		} else if !noDupCheck && err != ErrEdgeAlreadyUsed {
+			t.Errorf("Expected %q, got %q", ErrEdgeAlreadyUsed, err)
+		}
+	}
+}
+
+func TestEncodeHashStateFactoryUnsafeNoDupCheckOverwrite(t *testing.T) {
+	for _, stateType := range []StateType{LAZYDFAANNOTATED,
+		LAZYDFAEDGEDATA} {
+		for _, incremental := range []bool{false, true} {
+			factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+			factory.IncrementalHash = incremental
+			if err := factory.SetDefaultStateType(stateType); err != nil {
+				t.Fatalf("Error while setting default state type: %q", err)
+			}
+			states := newTestStates(t, factory, 4)
+			addTestEdge(t, states[3], "a", states[2])
+			expectedHash, err := states[3].IsomorphismHash()
+			if err != nil {
+				t.Fatalf("Error while obtaining IsomorphismHash: %q", err)
+			}
+
+			// Overwrite an edge carrying data on an otherwise identical
+			// state.
+			addTestEdge(t, states[0], "a", states[1])
+			if dataState, ok := states[0].(EdgeDataState); ok {
+				if err := dataState.SetEdgeData("a", "X"); err != nil {
+					t.Fatalf("Error while setting edge data: %q", err)
+				}
+			}
+			switch state := states[0].(type) {
+			case *LazyDfaAnnotatedState:
+				state.UnsafeNoDupCheck = true
+			case *LazyDfaEdgeDataState:
+				state.UnsafeNoDupCheck = true
+			}
+			addTestEdge(t, states[0], "a", states[2])
+
+			if dest := states[0].FollowEdge("a"); len(dest) != 1 ||
+				dest[0] != states[2] {
+				t.Errorf("Expected overwritten edge to lead to %v, got %v",
+					states[2], dest)
+			}
+			if dataState, ok := states[0].(EdgeDataState); ok {
+				if data, present := dataState.GetEdgeData("a"); present {
+					t.Errorf("Expected replaced edge data to be dropped, "+
+						"got %v", data)
+				}
+			}
+			if hash, err := states[0].IsomorphismHash(); err != nil {
+				t.Errorf("Error while obtaining IsomorphismHash: %q", err)
+			} else if hash != expectedHash {
+				t.Errorf("State type %d, incremental %t: hash %d, want %d",
+					stateType, incremental, hash, expectedHash)
+			}
+		}
+	}
+}
+
+func benchmarkUnsafeNoDupCheck(b *testing.B, noDupCheck bool) {
+	startState := newRandomTestTrie(b, 2000)
+	records := dumpTestMachine(startState)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		factory := newTestStateFactory(b).(*EncodeHashStateFactory)
+		factory.UnsafeNoDupCheck = noDupCheck
+		loadTestMachine(b, factory, records, startState.GetId())
+	}
+}
+
+func BenchmarkEncodeHashStateFactoryDupCheckLoad(b *testing.B) {
+	benchmarkUnsafeNoDupCheck(b, false)
+}
+
+func BenchmarkEncodeHashStateFactoryNoDupCheckLoad(b *testing.B) {
+	benchmarkUnsafeNoDupCheck(b, true)
+}
+
+// A handle of a type the codec package does not provide, so that its
+// Canonical option cannot be inspected.
+type opaqueTestHandle struct {
+	*codec.BincHandle
+}
+
+func TestVerifyHashStability(t *testing.T) {
+	states := newTestStates(t, newTestStateFactory(t), 2)
+	for edge := 'a'; edge <= 'z'; edge++ {
+		addTestEdge(t, states[0], edge, states[1])
+	}
+
+	canonicalHandle := new(codec.BincHandle)
+	canonicalHandle.Canonical = true
+	if err := VerifyHashStability(states[0], []codec.Handle{canonicalHandle,
+		opaqueTestHandle{canonicalHandle}}); err != nil {
+		t.Errorf("Error while verifying hash stability: %q", err)
+	}
+
+	if err := VerifyHashStability(states[0], []codec.Handle{canonicalHandle,
+		new(codec.BincHandle)}); !errors.Is(err, ErrNonCanonicalCodec) {
+		t.Errorf("Expected %q, got %q", ErrNonCanonicalCodec, err)
+	}
+	if err := VerifyHashStability(states[0], []codec.Handle{
+		opaqueTestHandle{new(codec.BincHandle)}}); !errors.Is(err,
+		ErrUnstableEncoding) {
+		t.Errorf("Expected %q, got %q", ErrUnstableEncoding, err)
+	}
+
+	// Transitions that encode alike are only told apart by their keys, so
+	// only the keyed edges that IsomorphismHash encodes are stable.
+	symbolKeys := make(map[*testPointerSymbol]int)
+	factory := newTestStateFactory(t).(*EncodeHashStateFactory)
+	factory.TransitionKeyFunc = func(edge interface{}) interface{} {
+		return symbolKeys[edge.(*testPointerSymbol)]
+	}
+	states = newTestStates(t, factory, 27)
+	for i := 1; i < len(states); i++ {
+		symbol := &testPointerSymbol{Name: "same"}
+		symbolKeys[symbol] = i
+		addTestEdge(t, states[0], symbol, states[i])
+	}
+	if err := VerifyHashStability(states[0],
+		[]codec.Handle{canonicalHandle}); err != nil {
+		t.Errorf("Error while verifying hash stability: %q", err)
+	}
+}
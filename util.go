@@ -1,5 +1,7 @@
 package wilddawg
 
+import "reflect"
+
 func sameMachineEdges(a map[interface{}]StateId,
 	b map[interface{}]StateId) bool {
 	if len(a) != len(b) {
@@ -15,6 +17,49 @@ func sameMachineEdges(a map[interface{}]StateId,
 	return true
 }
 
+// Compares machine edges using symbolEqual for transitions, falling back to
+// sameMachineEdges when it is nil. Each edge of a is matched against every edge
+// of b, so this is quadratic in the out-degree.
+func sameMachineEdgesWith(a map[interface{}]StateId,
+	b map[interface{}]StateId, symbolEqual SymbolEqualFunc) bool {
+	if symbolEqual == nil {
+		return sameMachineEdges(a, b)
+	}
+	if len(a) != len(b) {
+		return false
+	}
+	for a_key, a_val := range a {
+		matched := false
+		for b_key, b_val := range b {
+			if a_val == b_val && symbolEqual(a_key, b_key) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether two maps have the same keys with deeply equal values. A nil
+// map is the same as an empty one.
+func sameValues(a map[interface{}]interface{},
+	b map[interface{}]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, a_val := range a {
+		if b_val, present := b[k]; !present {
+			return false
+		} else if !reflect.DeepEqual(a_val, b_val) {
+			return false
+		}
+	}
+	return true
+}
+
 func slicesSameValues(a []interface{}, b []interface{}) bool {
 	if len(a) != len(b) {
 		return false
@@ -33,3 +78,31 @@ func slicesSameValues(a []interface{}, b []interface{}) bool {
 	}
 	return true
 }
+
+// Returns the length of the longest common prefix of two words, comparing
+// symbols with ==. This is the point at which the incremental construction
+// algorithm starts adding states for the second of two consecutive words.
+func CommonPrefixLength(a []interface{}, b []interface{}) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// Returns the number of states of the unminimized trie over the words,
+// including the start state, computed in one pass without building it. The
+// words must be sorted, as for incremental construction: in sorted input, the
+// longest prefix a word shares with any earlier word is the one it shares
+// with the word immediately before it. Repeated words add no states.
+// Comparing the result with the state count of the minimal machine, e.g. from
+// DistinctSuffixes, shows how much minimization saves.
+func TrieStateCount(words [][]interface{}) int {
+	stateCount := 1
+	var prevWord []interface{}
+	for _, word := range words {
+		stateCount += len(word) - CommonPrefixLength(prevWord, word)
+		prevWord = word
+	}
+	return stateCount
+}
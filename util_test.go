@@ -0,0 +1,60 @@
+package wilddawg
+
+import (
+	"testing"
+)
+
+func TestCommonPrefixLength(t *testing.T) {
+	testCases := []struct {
+		a        []interface{}
+		b        []interface{}
+		expected int
+	}{
+		{[]interface{}{"c", "a", "t"}, []interface{}{"c", "a", "t"}, 3},
+		{[]interface{}{"c", "a", "t"}, []interface{}{"d", "o", "g"}, 0},
+		{[]interface{}{"c", "a"}, []interface{}{"c", "a", "t"}, 2},
+		{[]interface{}{"c", "a", "t"}, []interface{}{"c", "a", "b"}, 2},
+		{[]interface{}{1, 2}, []interface{}{1, "2"}, 1},
+		{[]interface{}{}, []interface{}{"c"}, 0},
+		{nil, nil, 0},
+	}
+	for _, testCase := range testCases {
+		if length := CommonPrefixLength(testCase.a, testCase.b); length !=
+			testCase.expected {
+			t.Errorf("Common prefix length of %v and %v: %d, want %d",
+				testCase.a, testCase.b, length, testCase.expected)
+		}
+	}
+}
+
+func TestTrieStateCount(t *testing.T) {
+	lexicon := []string{"nation", "nations", "ration", "rations", "station",
+		"stations", "stations"}
+	words := make([][]interface{}, 0, len(lexicon))
+	for _, word := range lexicon {
+		symbols := make([]interface{}, 0, len(word))
+		for _, symbol := range word {
+			symbols = append(symbols, symbol)
+		}
+		words = append(words, symbols)
+	}
+
+	trieStateCount := TrieStateCount(words)
+	startState := newTestTrie(t, newTestStateFactory(t), lexicon)
+	if stateCount := len(OrderedStates(startState)); trieStateCount !=
+		stateCount {
+		t.Errorf("Trie state count %d, want %d", trieStateCount, stateCount)
+	}
+	if trieStateCount != 23 {
+		t.Errorf("Trie state count %d, want 23", trieStateCount)
+	}
+	if minimalStateCount, err := DistinctSuffixes(startState); err != nil {
+		t.Errorf("Error while counting distinct suffixes: %q", err)
+	} else if minimalStateCount != 9 {
+		t.Errorf("Minimal state count %d, want 9", minimalStateCount)
+	}
+
+	if count := TrieStateCount(nil); count != 1 {
+		t.Errorf("Expected only the start state for no words, got %d", count)
+	}
+}